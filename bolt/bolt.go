@@ -0,0 +1,402 @@
+package bolt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"github.com/breunigs/photoepics/cheapruler"
+	"github.com/breunigs/photoepics/mapillary"
+	"github.com/breunigs/photoepics/store"
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+	"github.com/paulmach/orb/maptile"
+	bbolt "go.etcd.io/bbolt"
+)
+
+// photo key → JSON encoded mapillary.Photo
+var photosBucket = []byte("photos")
+
+// grid cell (x, y as big endian uint32) + photo key → nothing
+var gridBucket = []byte("grid")
+
+// session name → nested bucket with the keys below
+var sessionsBucket = []byte("sessions")
+
+// GeoJSON encoded LineString of the loaded track
+var trackKey = []byte("track")
+
+// nested bucket: photo key → distance from path as big endian float64 bits
+var distBucket = []byte("dist")
+
+// nested bucket: from uid + 0x00 + to uid → weight as big endian float64 bits
+var edgesBucket = []byte("edges")
+
+// nested bucket: name of completed load step → nothing
+var doneBucket = []byte("done")
+
+var allBuckets = [][]byte{photosBucket, gridBucket, sessionsBucket}
+
+// Store implements store.Store on top of a single bbolt file. The file
+// contains everything needed to query, so it can be copied elsewhere.
+type Store struct {
+	db *bbolt.DB
+}
+
+func New(path string) Store {
+	db, err := bbolt.Open(path, 0644, &bbolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		log.Fatalf("Failed to open DB file %s: %+v", path, err)
+	}
+	s := Store{db: db}
+	s.CreateSchema()
+	return s
+}
+
+func (s Store) update(fn func(tx *bbolt.Tx) error) {
+	if err := s.db.Update(fn); err != nil {
+		log.Fatalf("Failed to write to DB file: %+v", err)
+	}
+}
+
+func (s Store) view(fn func(tx *bbolt.Tx) error) {
+	if err := s.db.View(fn); err != nil {
+		log.Fatalf("Failed to read from DB file: %+v", err)
+	}
+}
+
+func (s Store) CreateSchema() {
+	s.update(func(tx *bbolt.Tx) error {
+		for _, name := range allBuckets {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func gridKey(cell maptile.Tile, photoKey string) []byte {
+	k := make([]byte, 8, 8+len(photoKey))
+	binary.BigEndian.PutUint32(k[0:4], cell.X)
+	binary.BigEndian.PutUint32(k[4:8], cell.Y)
+	return append(k, photoKey...)
+}
+
+func encodeFloat(f float64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, math.Float64bits(f))
+	return b
+}
+
+func decodeFloat(b []byte) float64 {
+	return math.Float64frombits(binary.BigEndian.Uint64(b))
+}
+
+func edgeKey(from, to string) []byte {
+	k := make([]byte, 0, len(from)+1+len(to))
+	k = append(k, from...)
+	k = append(k, 0)
+	return append(k, to...)
+}
+
+func (s Store) CreateSession(sess store.Session) {
+	track, err := geojson.NewGeometry(sess.Track).MarshalJSON()
+	if err != nil {
+		log.Fatalf("Failed to encode track of session %s: %+v", sess.Name, err)
+	}
+
+	s.update(func(tx *bbolt.Tx) error {
+		sb := tx.Bucket(sessionsBucket)
+		if sb.Bucket([]byte(sess.Name)) != nil {
+			if err := sb.DeleteBucket([]byte(sess.Name)); err != nil {
+				return err
+			}
+		}
+
+		b, err := sb.CreateBucket([]byte(sess.Name))
+		if err != nil {
+			return err
+		}
+		if _, err := b.CreateBucket(distBucket); err != nil {
+			return err
+		}
+		if _, err := b.CreateBucket(edgesBucket); err != nil {
+			return err
+		}
+		if _, err := b.CreateBucket(doneBucket); err != nil {
+			return err
+		}
+		return b.Put(trackKey, track)
+	})
+}
+
+func (s Store) Session(name string) (store.Session, bool) {
+	var sess store.Session
+	var found bool
+	s.view(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(sessionsBucket).Bucket([]byte(name))
+		if b == nil {
+			return nil
+		}
+
+		g, err := geojson.UnmarshalGeometry(b.Get(trackKey))
+		if err != nil {
+			return err
+		}
+		track, ok := g.Geometry().(orb.LineString)
+		if !ok {
+			return fmt.Errorf("track of session %s is a %s, not a LineString", name, g.Type)
+		}
+
+		sess = store.Session{Name: name, Track: track}
+		found = true
+		return nil
+	})
+	return sess, found
+}
+
+func (s Store) Sessions() []string {
+	var names []string
+	s.view(func(tx *bbolt.Tx) error {
+		return tx.Bucket(sessionsBucket).ForEach(func(k, v []byte) error {
+			names = append(names, string(k))
+			return nil
+		})
+	})
+	return names
+}
+
+func (s Store) DeleteSession(name string) {
+	s.update(func(tx *bbolt.Tx) error {
+		sb := tx.Bucket(sessionsBucket)
+		if sb.Bucket([]byte(name)) == nil {
+			return nil
+		}
+		return sb.DeleteBucket([]byte(name))
+	})
+}
+
+func (s Store) MarkDone(session string, steps []string) {
+	s.update(func(tx *bbolt.Tx) error {
+		b := sessionBucket(tx, session).Bucket(doneBucket)
+		for _, step := range steps {
+			if err := b.Put([]byte(step), nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s Store) DoneSteps(session string) map[string]bool {
+	done := make(map[string]bool)
+	s.view(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(sessionsBucket).Bucket([]byte(session))
+		if b == nil {
+			return nil
+		}
+		return b.Bucket(doneBucket).ForEach(func(k, v []byte) error {
+			done[string(k)] = true
+			return nil
+		})
+	})
+	return done
+}
+
+func sessionBucket(tx *bbolt.Tx, name string) *bbolt.Bucket {
+	b := tx.Bucket(sessionsBucket).Bucket([]byte(name))
+	if b == nil {
+		log.Fatalf("Session %q does not exist", name)
+	}
+	return b
+}
+
+func (s Store) InsertPhotos(session string, photos []*mapillary.Photo) {
+	s.update(func(tx *bbolt.Tx) error {
+		pb := tx.Bucket(photosBucket)
+		gb := tx.Bucket(gridBucket)
+		dists := sessionBucket(tx, session).Bucket(distBucket)
+
+		for _, p := range photos {
+			key := []byte(p.Key)
+			if old := pb.Get(key); old != nil {
+				var oldPic mapillary.Photo
+				if err := json.Unmarshal(old, &oldPic); err != nil {
+					return err
+				}
+				if err := gb.Delete(gridKey(store.GridCell(oldPic.Point()), oldPic.Key)); err != nil {
+					return err
+				}
+			}
+
+			// the image key is unique already, so use it as identifier
+			pic := *p
+			pic.Uid = p.Key
+			pic.DistFromPath = 0
+			encoded, err := json.Marshal(pic)
+			if err != nil {
+				return err
+			}
+			if err := pb.Put(key, encoded); err != nil {
+				return err
+			}
+			if err := gb.Put(gridKey(store.GridCell(pic.Point()), pic.Key), nil); err != nil {
+				return err
+			}
+			if err := dists.Put(key, encodeFloat(p.DistFromPath)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func getPhoto(tx *bbolt.Tx, key string) (mapillary.Photo, bool) {
+	var p mapillary.Photo
+	raw := tx.Bucket(photosBucket).Get([]byte(key))
+	if raw == nil {
+		return p, false
+	}
+	if err := json.Unmarshal(raw, &p); err != nil {
+		log.Fatalf("Failed to decode photo %s from DB file: %+v", key, err)
+	}
+	return p, true
+}
+
+func (s Store) PhotoByKey(key string) mapillary.Photo {
+	var p mapillary.Photo
+	var found bool
+	s.view(func(tx *bbolt.Tx) error {
+		p, found = getPhoto(tx, key)
+		return nil
+	})
+	if !found {
+		log.Fatalf("Expected to find exactly one photo with key=%s, but found 0", key)
+	}
+	return p
+}
+
+func (s Store) PhotosNear(session string, pt orb.Point, radius float64) []mapillary.Photo {
+	center := []float64{pt[0], pt[1]}
+	var near []mapillary.Photo
+
+	s.view(func(tx *bbolt.Tx) error {
+		dists := sessionBucket(tx, session).Bucket(distBucket)
+		c := tx.Bucket(gridBucket).Cursor()
+		for _, cell := range store.GridCellsAround(pt, radius) {
+			prefix := gridKey(cell, "")
+			for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+				key := k[len(prefix):]
+				dist := dists.Get(key)
+				if dist == nil {
+					continue
+				}
+				p, ok := getPhoto(tx, string(key))
+				if ok && cheapruler.Dist(center, p.Loc.Coords) <= radius {
+					p.DistFromPath = decodeFloat(dist)
+					near = append(near, p)
+				}
+			}
+		}
+		return nil
+	})
+	return near
+}
+
+func (s Store) PhotoCount() int64 {
+	var n int
+	s.view(func(tx *bbolt.Tx) error {
+		n = tx.Bucket(photosBucket).Stats().KeyN
+		return nil
+	})
+	return int64(n)
+}
+
+func (s Store) InsertEdges(session string, edges []store.Edge) {
+	s.update(func(tx *bbolt.Tx) error {
+		b := sessionBucket(tx, session).Bucket(edgesBucket)
+		for _, e := range edges {
+			if err := b.Put(edgeKey(e.From, e.To), encodeFloat(e.Weight)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s Store) EdgeCount(session string) int64 {
+	var n int
+	s.view(func(tx *bbolt.Tx) error {
+		if b := tx.Bucket(sessionsBucket).Bucket([]byte(session)); b != nil {
+			n = b.Bucket(edgesBucket).Stats().KeyN
+		}
+		return nil
+	})
+	return int64(n)
+}
+
+func neighbors(edges *bbolt.Bucket, uid string) []store.Edge {
+	var out []store.Edge
+	prefix := edgeKey(uid, "")
+	c := edges.Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		out = append(out, store.Edge{
+			From:   uid,
+			To:     string(k[len(prefix):]),
+			Weight: decodeFloat(v),
+		})
+	}
+	return out
+}
+
+func (s Store) ShortestPaths(session string, from, to mapillary.Photo, n int, maxOverlap float64) []store.Path {
+	var paths []store.Path
+	s.view(func(tx *bbolt.Tx) error {
+		sb := sessionBucket(tx, session)
+		edges := sb.Bucket(edgesBucket)
+		dists := sb.Bucket(distBucket)
+
+		found := store.AlternativePaths(from.Uid, to.Uid, func(uid string) []store.Edge {
+			return neighbors(edges, uid)
+		}, n, maxOverlap)
+
+		for _, f := range found {
+			photos := make([]mapillary.Photo, len(f.Uids))
+			for i, uid := range f.Uids {
+				photos[i], _ = getPhoto(tx, uid)
+				if dist := dists.Get([]byte(uid)); dist != nil {
+					photos[i].DistFromPath = decodeFloat(dist)
+				}
+			}
+			paths = append(paths, store.Path{Photos: photos, Cost: f.Cost})
+		}
+		return nil
+	})
+	return paths
+}
+
+func (s Store) PurgeEverything() {
+	s.update(func(tx *bbolt.Tx) error {
+		for _, name := range allBuckets {
+			if tx.Bucket(name) == nil {
+				continue
+			}
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	s.CreateSchema()
+}
+
+func (s Store) Close() {
+	if err := s.db.Close(); err != nil {
+		log.Printf("Failed to close DB file: %+v", err)
+	}
+}
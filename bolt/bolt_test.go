@@ -0,0 +1,182 @@
+package bolt
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/breunigs/photoepics/cheapruler"
+	"github.com/breunigs/photoepics/mapillary"
+	"github.com/breunigs/photoepics/store"
+	"github.com/paulmach/orb"
+)
+
+var track = orb.LineString{{13.3777, 52.5165}, {13.3790, 52.5165}}
+
+func photo(key string, lon float64, dist float64) *mapillary.Photo {
+	p := &mapillary.Photo{
+		Key:         key,
+		Sequence:    "seq",
+		CameraAngle: 90,
+		MergeCC:     1,
+		Captured:    time.Unix(1600000000, 0).UTC(),
+	}
+	p.SetLocation(orb.Point{lon, 52.5165})
+	p.DistFromPath = dist
+	return p
+}
+
+func keys(photos []mapillary.Photo) []string {
+	keys := []string{}
+	for _, p := range photos {
+		keys = append(keys, p.Key)
+	}
+	return keys
+}
+
+// openTemp returns a store in a new file, and a function to remove it
+func openTemp(t *testing.T) (Store, string, func()) {
+	dir, err := ioutil.TempDir("", "photoepics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "epic.bolt")
+	return New(path), path, func() { os.RemoveAll(dir) }
+}
+
+func TestReopen(t *testing.T) {
+	cheapruler.Init(52.5165)
+	s, path, cleanup := openTemp(t)
+	defer cleanup()
+
+	s.CreateSession(store.Session{Name: "test", Track: track})
+	s.InsertPhotos("test", []*mapillary.Photo{photo("a", 13.3777, 1), photo("b", 13.3778, 2), photo("c", 13.3779, 3)})
+	s.InsertEdges("test", []store.Edge{{From: "a", To: "b", Weight: 1}, {From: "b", To: "c", Weight: 2}})
+	s.MarkDone("test", []string{"tile 1", "tile 2"})
+	s.Close()
+
+	s = New(path)
+	defer s.Close()
+	if got := s.Sessions(); !reflect.DeepEqual(got, []string{"test"}) {
+		t.Errorf("Got sessions %q, expected [test]", got)
+	}
+	if sess, ok := s.Session("test"); !ok || !reflect.DeepEqual(sess.Track, track) {
+		t.Errorf("Session track is %v, expected %v", sess.Track, track)
+	}
+	if got := s.DoneSteps("test"); !reflect.DeepEqual(got, map[string]bool{"tile 1": true, "tile 2": true}) {
+		t.Errorf("Got done steps %v, expected both tiles", got)
+	}
+	if got := s.PhotoCount(); got != 3 {
+		t.Errorf("Got %d photos, expected 3", got)
+	}
+	if got := s.EdgeCount("test"); got != 2 {
+		t.Errorf("Got %d edges, expected 2", got)
+	}
+
+	// the distance is kept per session, not with the photo
+	want := *photo("b", 13.3778, 0)
+	want.Uid = "b"
+	if got := s.PhotoByKey("b"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Got photo\n%+v\nexpected\n%+v", got, want)
+	}
+	near := s.PhotosNear("test", orb.Point{13.3778, 52.5165}, 5)
+	if len(near) != 1 || near[0].Key != "b" || near[0].DistFromPath != 2 {
+		t.Errorf("Got photos near b %+v, expected only b with its distance", near)
+	}
+
+	paths := s.ShortestPaths("test", s.PhotoByKey("a"), s.PhotoByKey("c"), 1, 0.5)
+	if len(paths) != 1 || paths[0].Cost != 3 {
+		t.Fatalf("Got paths %+v, expected one with cost 3", paths)
+	}
+	if got := keys(paths[0].Photos); !reflect.DeepEqual(got, []string{"a", "b", "c"}) {
+		t.Errorf("Got path %q, expected [a b c]", got)
+	}
+	if got := paths[0].Photos[2].DistFromPath; got != 3 {
+		t.Errorf("Path ends at distance %v, expected 3", got)
+	}
+}
+
+func TestSessions(t *testing.T) {
+	cheapruler.Init(52.5165)
+	s, _, cleanup := openTemp(t)
+	defer cleanup()
+	defer s.Close()
+
+	s.CreateSession(store.Session{Name: "one", Track: track})
+	s.CreateSession(store.Session{Name: "two", Track: track})
+	s.InsertPhotos("one", []*mapillary.Photo{photo("a", 13.3777, 1)})
+	s.InsertPhotos("two", []*mapillary.Photo{photo("b", 13.3778, 2)})
+	s.InsertEdges("one", []store.Edge{{From: "a", To: "b", Weight: 1}})
+
+	// photos are shared, but only those loaded for the session are near
+	pt := orb.Point{13.3777, 52.5165}
+	if got := keys(s.PhotosNear("one", pt, 50)); !reflect.DeepEqual(got, []string{"a"}) {
+		t.Errorf("Got photos %q near session one, expected [a]", got)
+	}
+	if got := keys(s.PhotosNear("two", pt, 50)); !reflect.DeepEqual(got, []string{"b"}) {
+		t.Errorf("Got photos %q near session two, expected [b]", got)
+	}
+	if got := s.EdgeCount("two"); got != 0 {
+		t.Errorf("Session two has %d edges, expected none", got)
+	}
+
+	// loading a session again starts it over
+	s.MarkDone("one", []string{"tile 1"})
+	s.CreateSession(store.Session{Name: "one", Track: track})
+	if got := s.EdgeCount("one"); got != 0 {
+		t.Errorf("Recreated session has %d edges, expected none", got)
+	}
+	if got := s.DoneSteps("one"); len(got) != 0 {
+		t.Errorf("Recreated session has done steps %v, expected none", got)
+	}
+
+	s.DeleteSession("two")
+	s.DeleteSession("unknown")
+	if got := s.Sessions(); !reflect.DeepEqual(got, []string{"one"}) {
+		t.Errorf("Got sessions %q, expected [one]", got)
+	}
+	if got := s.PhotoCount(); got != 2 {
+		t.Errorf("Got %d photos after deleting a session, expected 2", got)
+	}
+
+	s.PurgeEverything()
+	if got, count := s.Sessions(), s.PhotoCount(); len(got) != 0 || count != 0 {
+		t.Errorf("Got sessions %q and %d photos after purging, expected none", got, count)
+	}
+}
+
+func TestUpserts(t *testing.T) {
+	cheapruler.Init(52.5165)
+	s, _, cleanup := openTemp(t)
+	defer cleanup()
+	defer s.Close()
+
+	s.CreateSession(store.Session{Name: "test", Track: track})
+	s.InsertPhotos("test", []*mapillary.Photo{photo("a", 13.3777, 1), photo("b", 13.3778, 2)})
+	s.InsertEdges("test", []store.Edge{{From: "a", To: "b", Weight: 5}})
+
+	// a photo that moved is only found at its new location
+	s.InsertPhotos("test", []*mapillary.Photo{photo("a", 13.3790, 1)})
+	if got := s.PhotoCount(); got != 2 {
+		t.Errorf("Got %d photos, expected 2", got)
+	}
+	if got := keys(s.PhotosNear("test", orb.Point{13.3777, 52.5165}, 5)); len(got) != 0 {
+		t.Errorf("Got photos %q at the old location, expected none", got)
+	}
+	if got := keys(s.PhotosNear("test", orb.Point{13.3790, 52.5165}, 5)); !reflect.DeepEqual(got, []string{"a"}) {
+		t.Errorf("Got photos %q at the new location, expected [a]", got)
+	}
+
+	// a resumed load may calculate the same edge again
+	s.InsertEdges("test", []store.Edge{{From: "a", To: "b", Weight: 1}})
+	if got := s.EdgeCount("test"); got != 1 {
+		t.Errorf("Got %d edges, expected 1", got)
+	}
+	paths := s.ShortestPaths("test", s.PhotoByKey("a"), s.PhotoByKey("b"), 1, 0.5)
+	if len(paths) != 1 || paths[0].Cost != 1 {
+		t.Errorf("Got paths %+v, expected one with the new weight 1", paths)
+	}
+}
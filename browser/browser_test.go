@@ -0,0 +1,37 @@
+package browser
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+)
+
+// TestMain runs the tests in a temporary directory, since the cache is kept
+// in the working directory
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "photoepics")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		log.Fatal(err)
+	}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// countingServer serves with handler and counts the requests. Each server
+// has a host of its own, so its responses are not cached yet.
+func countingServer(handler http.HandlerFunc) (*httptest.Server, *int32) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		handler(w, r)
+	}))
+	return srv, &requests
+}
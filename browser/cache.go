@@ -9,6 +9,7 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 	"time"
 
@@ -18,40 +19,211 @@ import (
 const maxCacheSize = 264 * 1024 * 1024 // 264 MiB
 const basePath = ".browserCache"
 
-var expireTime = 30 * 24 * time.Hour // 1 month
+// DefaultTTL is how long entries are kept by default
+const DefaultTTL = 30 * 24 * time.Hour // 1 month
+
+// TTL is how long entries are used without asking the server again. Older
+// ones are revalidated if possible, or removed on start otherwise. 0 means
+// entries never become stale.
+var TTL = DefaultTTL
 
 var diskCache = diskv.New(diskv.Options{
-	BasePath: ".browserCache",
+	BasePath: basePath,
 	// Transform:    blockTransform,
 	AdvancedTransform: advancedTransform,
 	InverseTransform:  inverseTransform,
 	CacheSizeMax:      maxCacheSize,
 })
 
-func WriteToCache(uri string, val []byte) error {
-	return diskCache.Write(url2key(uri), val)
+func WriteToCache(uri string, e Entry) error {
+	e.Header.URL = normalizeURL(uri)
+	raw, err := e.encode()
+	if err != nil {
+		return err
+	}
+	return diskCache.Write(url2key(uri), raw)
+}
+
+// ReadFromCache returns the cached response for the URL, if there is one.
+// Entries without a header are returned as they are.
+func ReadFromCache(uri string) (Entry, bool) {
+	raw, err := diskCache.Read(url2key(uri))
+	if err != nil || len(raw) == 0 {
+		raw, err = migrateEntry(uri)
+	}
+	if err != nil || len(raw) == 0 {
+		return Entry{}, false
+	}
+	e, err := decodeEntry(raw)
+	if err != nil {
+		log.Printf("Ignoring broken cache entry for %s: %v", displayURL(uri), err)
+		return Entry{}, false
+	}
+	return e, true
+}
+
+// migrateEntry moves an entry stored under its legacy key, which included
+// the credentials, to the current key. Since only the hash of the URL is
+// known for those, they can only be found once the same URL is requested
+// again.
+func migrateEntry(uri string) ([]byte, error) {
+	legacy := legacyKey(uri)
+	raw, err := diskCache.Read(legacy)
+	if err != nil {
+		return nil, err
+	}
+	if e, err := decodeEntry(raw); err == nil && !e.Header.Legacy {
+		e.Header.URL = normalizeURL(uri)
+		if encoded, err := e.encode(); err == nil {
+			raw = encoded
+		}
+	}
+	if err := diskCache.Write(url2key(uri), raw); err != nil {
+		log.Printf("Failed to migrate cache entry for %s: %v", displayURL(uri), err)
+		return raw, nil
+	}
+	diskCache.Erase(legacy)
+	return raw, nil
 }
 
-func ReadFromCache(uri string) string {
-	return diskCache.ReadString(url2key(uri))
+// Expire removes cache entries older than the given age. Entries that can be
+// revalidated are kept if keepRevalidatable is set. It returns how many were
+// removed.
+func Expire(olderThan time.Duration, keepRevalidatable bool) int {
+	expireBefore := time.Now().Add(-olderThan)
+
+	removed := 0
+	walkCache(func(path string, info os.FileInfo) {
+		if !info.ModTime().Before(expireBefore) {
+			return
+		}
+		if keepRevalidatable {
+			if h, err := readEntryHeader(path); err == nil && h.revalidatable() {
+				return
+			}
+		}
+		if err := os.Remove(path); err != nil {
+			log.Printf("Failed to expire %s: %v", path, err)
+			return
+		}
+		removed++
+	})
+	return removed
 }
 
-func Expire() {
+// EnforceSizeCap removes the oldest cache entries until all of them together
+// take at most maxBytes. It returns how many were removed.
+func EnforceSizeCap(maxBytes int64) int {
+	type entry struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	var entries []entry
+	var total int64
+	walkCache(func(path string, info os.FileInfo) {
+		entries = append(entries, entry{path, info.Size(), info.ModTime()})
+		total += info.Size()
+	})
+	if total <= maxBytes {
+		return 0
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].modTime.Before(entries[j].modTime)
+	})
+	removed := 0
+	for _, e := range entries {
+		if total <= maxBytes {
+			break
+		}
+		if err := os.Remove(e.path); err != nil {
+			log.Printf("Failed to remove %s: %v", e.path, err)
+			continue
+		}
+		total -= e.size
+		removed++
+	}
+	return removed
+}
+
+// Clear removes all cache entries for the given host, or all of them if the
+// host is empty. It returns how many were removed.
+func Clear(host string) int {
+	removed := 0
+	walkCache(func(path string, info os.FileInfo) {
+		if host != "" && hostOfEntry(path) != host {
+			return
+		}
+		if err := os.Remove(path); err != nil {
+			log.Printf("Failed to remove %s: %v", path, err)
+			return
+		}
+		removed++
+	})
+	return removed
+}
+
+// CacheStats describes what is in the cache
+type CacheStats struct {
+	Entries int
+	Bytes   int64
+	Hosts   map[string]*HostStats
+	// number of entries per age, see AgeBuckets
+	Ages []int
+}
+
+type HostStats struct {
+	Entries int
+	Bytes   int64
+}
+
+// AgeBuckets are the upper bounds of the age histogram in CacheStats. The
+// last bucket holds everything older.
+var AgeBuckets = []time.Duration{
+	24 * time.Hour,
+	7 * 24 * time.Hour,
+	30 * 24 * time.Hour,
+	90 * 24 * time.Hour,
+}
+
+func Stats() CacheStats {
+	stats := CacheStats{
+		Hosts: make(map[string]*HostStats),
+		Ages:  make([]int, len(AgeBuckets)+1),
+	}
+	now := time.Now()
+	walkCache(func(path string, info os.FileInfo) {
+		stats.Entries++
+		stats.Bytes += info.Size()
+
+		host := hostOfEntry(path)
+		if stats.Hosts[host] == nil {
+			stats.Hosts[host] = &HostStats{}
+		}
+		stats.Hosts[host].Entries++
+		stats.Hosts[host].Bytes += info.Size()
+
+		age := now.Sub(info.ModTime())
+		bucket := sort.Search(len(AgeBuckets), func(i int) bool { return age < AgeBuckets[i] })
+		stats.Ages[bucket]++
+	})
+	return stats
+}
+
+// walkCache calls fn for each file in the cache directory
+func walkCache(fn func(path string, info os.FileInfo)) {
 	if _, err := os.Stat(basePath); os.IsNotExist(err) {
 		return
 	}
 
-	expireBefore := time.Now().Add(-expireTime)
-
 	err := filepath.Walk(basePath, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
-			log.Fatalf("cannot walk cache dir %q: %v\n", basePath, err)
+			return err
 		}
-		if !info.IsDir() && info.ModTime().Before(expireBefore) {
-			log.Printf("Epxiring %s (created: %s)", path, info.ModTime())
-			return os.Remove(path)
+		if !info.IsDir() {
+			fn(path, info)
 		}
-
 		return nil
 	})
 	if err != nil {
@@ -59,6 +231,15 @@ func Expire() {
 	}
 }
 
+// entries are stored as <basePath>/<host>/<path>/<md5>, see url2key
+func hostOfEntry(path string) string {
+	rel, err := filepath.Rel(basePath, path)
+	if err != nil {
+		return ""
+	}
+	return strings.SplitN(filepath.ToSlash(rel), "/", 2)[0]
+}
+
 func advancedTransform(key string) *diskv.PathKey {
 	slice := strings.Split(key, "__")
 	last := len(slice) - 1
@@ -77,16 +258,27 @@ func inverseTransform(pathKey *diskv.PathKey) (key string) {
 // 	return slice[:len(slice)-1]
 // }
 
+// url2key turns the URL into <host>__<path>__<hash>. The hash ignores
+// credentials, see normalizeURL.
 func url2key(uri string) string {
+	return keyWithHash(uri, md5(normalizeURL(uri)))
+}
+
+// legacyKey is how entries were stored before credentials were ignored
+func legacyKey(uri string) string {
+	return keyWithHash(uri, md5(uri))
+}
+
+func keyWithHash(uri string, hash string) string {
 	u, err := url.Parse(uri)
 	if err != nil {
-		log.Fatal(err)
+		log.Fatal(redactError(err))
 	}
 
 	re := regexp.MustCompile("[^a-zA-Z0-9-]")
 	path := re.ReplaceAllString(u.Path, "")
 
-	return fmt.Sprintf("%s__%s__%s", u.Host, path, md5(uri))
+	return fmt.Sprintf("%s__%s__%s", u.Host, path, hash)
 }
 
 func md5(text string) string {
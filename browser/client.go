@@ -0,0 +1,43 @@
+package browser
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+)
+
+// NewHTTPClient creates a client for Browser that sends requests through the
+// given proxy and also trusts the certificates in the PEM encoded caBundle,
+// e.g. for a company proxy that intercepts TLS. Empty values keep the
+// defaults, i.e. the proxy from the environment and the system's CAs.
+func NewHTTPClient(proxy string, caBundle string) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if proxy != "" {
+		proxyURL, err := url.Parse(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy: %v", redactError(err))
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	if caBundle != "" {
+		pem, err := ioutil.ReadFile(caBundle)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read CA bundle: %v", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", caBundle)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	return &http.Client{Timeout: readTimeout, Transport: transport}, nil
+}
@@ -0,0 +1,143 @@
+package browser
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+)
+
+// entries written since headers were introduced start with this line. Older
+// entries are just the raw body.
+const entryMagic = "photoepics-cache-v1\n"
+
+// EntryHeader describes how a cached response was fetched
+type EntryHeader struct {
+	// the requested URL without credentials, see normalizeURL
+	URL          string    `json:"url,omitempty"`
+	Fetched      time.Time `json:"fetched"`
+	Status       int       `json:"status"`
+	ContentType  string    `json:"contentType,omitempty"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"lastModified,omitempty"`
+	// length of the body as read, i.e. after truncation
+	Length int `json:"length"`
+	// whether the body was cut at maxReadSize
+	Truncated bool `json:"truncated,omitempty"`
+	// whether the entry has no header of its own, since it was written by an
+	// older version
+	Legacy bool `json:"-"`
+}
+
+// Entry is a cached response
+type Entry struct {
+	Header EntryHeader
+	Body   []byte
+}
+
+// revalidatable is true if the server gave us a way to ask whether the
+// response changed
+func (h EntryHeader) revalidatable() bool {
+	return h.ETag != "" || h.LastModified != ""
+}
+
+// stale entries are older than TTL. They are only kept if they can be
+// revalidated, otherwise they're removed on start.
+func (h EntryHeader) stale() bool {
+	if h.Legacy || TTL <= 0 {
+		return false
+	}
+	return time.Since(h.Fetched) > TTL
+}
+
+func newEntry(res *http.Response, body []byte, truncated bool) Entry {
+	return Entry{
+		Header: EntryHeader{
+			Fetched:      time.Now(),
+			Status:       res.StatusCode,
+			ContentType:  res.Header.Get("Content-Type"),
+			ETag:         res.Header.Get("ETag"),
+			LastModified: res.Header.Get("Last-Modified"),
+			Length:       len(body),
+			Truncated:    truncated,
+		},
+		Body: body,
+	}
+}
+
+// encode writes the magic line and the JSON header, followed by the gzipped
+// body
+func (e Entry) encode() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(entryMagic)
+	if err := json.NewEncoder(&buf).Encode(e.Header); err != nil {
+		return nil, err
+	}
+
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(e.Body); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// readEntryHeader reads only the header of the cache file at path
+func readEntryHeader(path string) (EntryHeader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return EntryHeader{}, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	magic := make([]byte, len(entryMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != entryMagic {
+		return EntryHeader{Legacy: true}, nil
+	}
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return EntryHeader{}, fmt.Errorf("missing header: %v", err)
+	}
+	var h EntryHeader
+	if err := json.Unmarshal(line, &h); err != nil {
+		return EntryHeader{}, fmt.Errorf("invalid header: %v", err)
+	}
+	return h, nil
+}
+
+func decodeEntry(raw []byte) (Entry, error) {
+	if !bytes.HasPrefix(raw, []byte(entryMagic)) {
+		return Entry{
+			Header: EntryHeader{Status: http.StatusOK, Length: len(raw), Legacy: true},
+			Body:   raw,
+		}, nil
+	}
+
+	r := bufio.NewReader(bytes.NewReader(raw[len(entryMagic):]))
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return Entry{}, fmt.Errorf("missing header: %v", err)
+	}
+	var e Entry
+	if err := json.Unmarshal(line, &e.Header); err != nil {
+		return Entry{}, fmt.Errorf("invalid header: %v", err)
+	}
+
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return Entry{}, fmt.Errorf("invalid body: %v", err)
+	}
+	if e.Body, err = ioutil.ReadAll(zr); err != nil {
+		return Entry{}, fmt.Errorf("invalid body: %v", err)
+	}
+	return e, nil
+}
@@ -0,0 +1,142 @@
+package browser
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestEntryRoundTrip(t *testing.T) {
+	e := Entry{
+		Header: EntryHeader{
+			URL:          "https://example.com/tile?z=14",
+			Fetched:      time.Date(2020, 6, 1, 10, 0, 0, 0, time.UTC),
+			Status:       http.StatusOK,
+			ContentType:  "application/json",
+			ETag:         `"abc"`,
+			LastModified: "Mon, 01 Jun 2020 10:00:00 GMT",
+			Length:       1100,
+		},
+		Body: bytes.Repeat([]byte("photoepics "), 100),
+	}
+	raw, err := e.encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(raw, []byte(entryMagic)) {
+		t.Errorf("Entry does not start with the magic line")
+	}
+	if len(raw) >= len(e.Body) {
+		t.Errorf("Body is not compressed")
+	}
+
+	got, err := decodeEntry(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, e) {
+		t.Errorf("Got entry\n%+v\nexpected\n%+v", got, e)
+	}
+
+	path := "entry"
+	if err := ioutil.WriteFile(path, raw, 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+	if h, err := readEntryHeader(path); err != nil || !reflect.DeepEqual(h, e.Header) {
+		t.Errorf("Got header %+v (%v), expected %+v", h, err, e.Header)
+	}
+}
+
+func TestLegacyEntry(t *testing.T) {
+	body := []byte(`{"type": "FeatureCollection"}`)
+	e, err := decodeEntry(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Entry{Header: EntryHeader{Status: http.StatusOK, Length: len(body), Legacy: true}, Body: body}
+	if !reflect.DeepEqual(e, want) {
+		t.Errorf("Got entry %+v, expected %+v", e, want)
+	}
+	// the file's age is all we know, so it's up to Expire
+	if e.Header.stale() {
+		t.Errorf("Legacy entry is stale")
+	}
+
+	path := "legacy"
+	if err := ioutil.WriteFile(path, body, 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+	if h, err := readEntryHeader(path); err != nil || !h.Legacy {
+		t.Errorf("Got header %+v (%v), expected a legacy one", h, err)
+	}
+}
+
+func TestBrokenEntries(t *testing.T) {
+	tests := map[string]string{
+		"no header":      entryMagic,
+		"invalid header": entryMagic + "{\n",
+		"invalid body":   entryMagic + "{}\nnot gzipped",
+	}
+	for name, raw := range tests {
+		if _, err := decodeEntry([]byte(raw)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestStale(t *testing.T) {
+	defer func(ttl time.Duration) { TTL = ttl }(TTL)
+	old := EntryHeader{Fetched: time.Now().Add(-2 * time.Hour)}
+
+	TTL = time.Hour
+	if !old.stale() {
+		t.Errorf("Entry older than TTL is not stale")
+	}
+	TTL = 3 * time.Hour
+	if old.stale() {
+		t.Errorf("Entry younger than TTL is stale")
+	}
+	TTL = 0
+	if old.stale() {
+		t.Errorf("Entry is stale, although entries never should be")
+	}
+}
+
+func TestGetCachesResponses(t *testing.T) {
+	srv, requests := countingServer(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"ok": true}`))
+	})
+	defer srv.Close()
+	url := srv.URL + "/cached?b=2&a=1"
+
+	for i := 0; i < 2; i++ {
+		body, err := Get(context.Background(), url)
+		if err != nil || body != `{"ok": true}` {
+			t.Fatalf("Got %q (%v), expected the response", body, err)
+		}
+	}
+	if n := atomic.LoadInt32(requests); n != 1 {
+		t.Errorf("Sent %d requests, expected the second to be cached", n)
+	}
+
+	e, ok := ReadFromCache(url)
+	if !ok {
+		t.Fatalf("Response was not cached")
+	}
+	h := e.Header
+	if h.URL != srv.URL+"/cached?a=1&b=2" || h.Status != http.StatusOK || h.ContentType != "application/json" || h.Length != 12 || h.Legacy {
+		t.Errorf("Got header %+v, expected the response's details", h)
+	}
+	if time.Since(h.Fetched) > time.Minute {
+		t.Errorf("Fetched at %v, expected just now", h.Fetched)
+	}
+}
@@ -1,11 +1,14 @@
 package browser
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -19,13 +22,42 @@ const userAgent = "photoepics/0.1"
 
 var activeUrls = sync.Map{}
 
-var client = &http.Client{
+// Offline serves responses only from the cache, even stale ones. URLs that
+// are not cached fail with ErrNotCached and are remembered for MissingURLs.
+var Offline bool
+
+// Refresh ignores cached responses, but still writes the new ones to the
+// cache
+var Refresh bool
+
+// ErrNotCached is returned in Offline mode for URLs missing from the cache
+var ErrNotCached = errors.New("not cached")
+
+var missingUrls = sync.Map{}
+
+var defaultClient = &http.Client{
 	Timeout: readTimeout,
 }
 
-func Get(url string) (result string, outerErr error) {
+// Browser reads URLs through the cache and the rate limits, like Get, but
+// sends requests with its own HTTP client. The zero value is ready to use.
+type Browser struct {
+	// Client sends the requests. Nil means a client with a default timeout,
+	// see NewHTTPClient for proxies and custom CAs.
+	Client *http.Client
+}
+
+// Get reads the given URL from the cache or the network, retrying on
+// temporary failures. It gives up once ctx is done or after maxAttempts.
+// Errors about the response's status are a *StatusError.
+func Get(ctx context.Context, url string) (string, error) {
+	return Browser{}.Get(ctx, url)
+}
+
+// Get works like the package's Get, but uses the browser's HTTP client
+func (b Browser) Get(ctx context.Context, url string) (result string, outerErr error) {
 	if strings.Contains(url, " ") {
-		log.Fatalf("Was given URL that contains a space. Please encode the URL properly or remove the space: %s", url)
+		log.Fatalf("Was given URL that contains a space. Please encode the URL properly or remove the space: %s", displayURL(url))
 	}
 
 	var newWg sync.WaitGroup
@@ -34,62 +66,136 @@ func Get(url string) (result string, outerErr error) {
 	wg, _ := obj.(*sync.WaitGroup)
 	if loaded {
 		wg.Wait()
-		return Get(url)
+		return b.Get(ctx, url)
 	}
 	defer activeUrls.Delete(url)
 	defer wg.Done()
 
+	policy := newRetryPolicy()
 	op := func() (innerErr error) {
-		result, innerErr = getNoRetry(url)
-		return
+		result, innerErr = b.getNoRetry(ctx, url)
+		if ctx.Err() != nil {
+			return backoff.Permanent(ctx.Err())
+		}
+		if innerErr != nil {
+			return policy.classify(innerErr)
+		}
+		return nil
 	}
 
-	exp := backoff.NewExponentialBackOff()
-	exp.InitialInterval = 5 * time.Second
-	outerErr = backoff.Retry(op, exp)
+	outerErr = backoff.Retry(op, backoff.WithContext(policy, ctx))
+	if ctx.Err() != nil {
+		outerErr = ctx.Err()
+	}
+	outerErr = redactError(outerErr)
 	return
 }
 
-func getNoRetry(url string) (string, error) {
-	fromCache := ReadFromCache(url)
-	if fromCache != "" {
-		return fromCache, nil
+// MissingURLs lists the URLs that failed with ErrNotCached so far, sorted and
+// redacted
+func MissingURLs() []string {
+	var urls []string
+	missingUrls.Range(func(key, _ interface{}) bool {
+		urls = append(urls, key.(string))
+		return true
+	})
+	sort.Strings(urls)
+	return urls
+}
+
+func (b Browser) client() *http.Client {
+	if b.Client == nil {
+		return defaultClient
 	}
+	return b.Client
+}
 
-	EnsureRateLimit(url)
+func (b Browser) getNoRetry(ctx context.Context, url string) (string, error) {
+	if Offline {
+		return getOffline(url)
+	}
 
-	// log.Printf("Reading %s\n", shorten(url))
-	req, err := http.NewRequest("GET", url, nil)
+	var cached Entry
+	ok := false
+	if !Refresh {
+		cached, ok = ReadFromCache(url)
+	}
+	if ok && cached.Header.Truncated {
+		ok = false
+	}
+	if ok && !cached.Header.stale() {
+		return string(cached.Body), nil
+	}
+
+	gate, err := acquireHost(ctx, url)
+	if err != nil {
+		return "", err
+	}
+	defer gate.release()
+
+	// log.Printf("Reading %s\n", displayURL(url))
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return "", err
 	}
 	req.Header.Set("User-Agent", userAgent)
+	if ok {
+		// only stale entries which can be revalidated are left
+		if cached.Header.ETag != "" {
+			req.Header.Set("If-None-Match", cached.Header.ETag)
+		}
+		if cached.Header.LastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.Header.LastModified)
+		}
+	}
 
-	res, err := client.Do(req)
+	res, err := b.client().Do(req)
 	if err != nil {
 		return "", err
 	}
 	defer res.Body.Close()
+	if ok && res.StatusCode == http.StatusNotModified {
+		gate.speedUp()
+		cached.Header.Fetched = time.Now()
+		if err := WriteToCache(url, cached); err != nil {
+			log.Printf("Failed to write disk cache for %s\n", displayURL(url))
+		}
+		return string(cached.Body), nil
+	}
+	if res.StatusCode == http.StatusTooManyRequests {
+		gate.slowDown()
+	}
 	if res.StatusCode != 200 {
-		err = fmt.Errorf("Unexpected status: got %v for %s", res.Status, url)
+		err := newStatusError(url, res)
 		log.Println(err)
 		return "", err
 	}
-	bodyBytes, err := ioutil.ReadAll(io.LimitReader(res.Body, maxReadSize))
+	// read one more byte to know whether the body is too long
+	bodyBytes, err := ioutil.ReadAll(io.LimitReader(res.Body, maxReadSize+1))
 	if err != nil {
 		return "", err
 	}
+	gate.speedUp()
+	truncated := len(bodyBytes) > maxReadSize
+	if truncated {
+		bodyBytes = bodyBytes[:maxReadSize]
+		log.Printf("Response for %s is larger than %d bytes, using only the beginning", displayURL(url), maxReadSize)
+	}
 
-	err = WriteToCache(url, bodyBytes)
+	err = WriteToCache(url, newEntry(res, bodyBytes, truncated))
 	if err != nil {
-		log.Printf("Failed to write disk cache for %s\n", url)
+		log.Printf("Failed to write disk cache for %s\n", displayURL(url))
 	}
 	return string(bodyBytes), nil
 }
 
-func shorten(url string) string {
-	if len(url) <= 200 {
-		return url
+// getOffline serves any cached response, since there is no way to get a
+// better one
+func getOffline(url string) (string, error) {
+	cached, ok := ReadFromCache(url)
+	if !ok {
+		missingUrls.Store(Redact(url), true)
+		return "", fmt.Errorf("%w: %s", ErrNotCached, displayURL(url))
 	}
-	return url[0:199] + "…"
+	return string(cached.Body), nil
 }
@@ -0,0 +1,85 @@
+package browser
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestOffline(t *testing.T) {
+	defer func(ttl time.Duration) { TTL = ttl }(TTL)
+	defer func() { Offline = false }()
+
+	srv, requests := countingServer(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("online"))
+	})
+	defer srv.Close()
+	cached := srv.URL + "/cached"
+	missing := srv.URL + "/missing?access_token=secret"
+
+	if _, err := Get(context.Background(), cached); err != nil {
+		t.Fatal(err)
+	}
+	Offline = true
+	// stale entries are served too, since there's nothing better
+	TTL = time.Millisecond
+	time.Sleep(2 * TTL)
+
+	if body, err := Get(context.Background(), cached); err != nil || body != "online" {
+		t.Errorf("Got %q (%v), expected the cached response", body, err)
+	}
+
+	start := time.Now()
+	_, err := Get(context.Background(), missing)
+	if !errors.Is(err, ErrNotCached) {
+		t.Errorf("Got error %v, expected ErrNotCached", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Took %v to fail, expected no retries", d)
+	}
+	if n := atomic.LoadInt32(requests); n != 1 {
+		t.Errorf("Sent %d requests, expected only the one before going offline", n)
+	}
+
+	want := srv.URL + "/missing?access_token=REDACTED"
+	found := false
+	for _, url := range MissingURLs() {
+		found = found || url == want
+	}
+	if !found {
+		t.Errorf("Missing URLs %q do not contain %s", MissingURLs(), want)
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	defer func() { Refresh = false }()
+
+	var version int32
+	srv, requests := countingServer(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&version, 1) == 1 {
+			w.Write([]byte("first"))
+		} else {
+			w.Write([]byte("second"))
+		}
+	})
+	defer srv.Close()
+	url := srv.URL + "/refreshed"
+
+	if _, err := Get(context.Background(), url); err != nil {
+		t.Fatal(err)
+	}
+	Refresh = true
+	if body, err := Get(context.Background(), url); err != nil || body != "second" {
+		t.Errorf("Got %q (%v), expected a new response", body, err)
+	}
+	Refresh = false
+	if body, err := Get(context.Background(), url); err != nil || body != "second" {
+		t.Errorf("Got %q (%v), expected the refreshed response from the cache", body, err)
+	}
+	if n := atomic.LoadInt32(requests); n != 2 {
+		t.Errorf("Sent %d requests, expected 2", n)
+	}
+}
@@ -2,39 +2,209 @@ package browser
 
 import (
 	"context"
+	"fmt"
 	"log"
+	"math"
 	"net/url"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 
 	"golang.org/x/time/rate"
 )
 
-const burstRate = 5
-const reqPerSec = 3
+// HostLimits configures how fast requests are sent to a host
+type HostLimits struct {
+	// requests per second. 0 means no limit.
+	Rate float64
+	// how many requests may be sent at once after a pause
+	Burst int
+	// how many requests may be in flight at the same time. 0 means no limit.
+	MaxConns int
+}
 
-var hostLimiters = sync.Map{}
+// DefaultLimits apply to hosts without limits of their own
+var DefaultLimits = HostLimits{Rate: 3, Burst: 5, MaxConns: 4}
 
-func EnsureRateLimit(uri string) {
-	host := hostFromUrl(uri)
-	err := getHostLimiter(host).Wait(context.Background())
-	if err != nil {
-		log.Fatal(err)
+// when a host answers with 429 Too Many Requests, the rate is halved, but not
+// below this fraction of the configured one. Each successful request then
+// raises it by 1/recoverySteps of the configured rate.
+const minRateFactor = 1.0 / 16
+const recoverySteps = 20
+
+var hostLimits = map[string]HostLimits{}
+var hostGates = sync.Map{}
+
+// SetHostLimits configures the limits for the given host. It has to be called
+// before the first request to that host.
+func SetHostLimits(host string, limits HostLimits) {
+	hostLimits[host] = limits
+}
+
+// ParseHostLimits reads limits in the form host=rate/burst/connections, e.g.
+// graph.mapillary.com=10/20/8
+func ParseHostLimits(s string) (string, HostLimits, error) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return "", HostLimits{}, fmt.Errorf("expected host=rate/burst/connections, got %q", s)
+	}
+	values := strings.Split(parts[1], "/")
+	if len(values) != 3 {
+		return "", HostLimits{}, fmt.Errorf("expected host=rate/burst/connections, got %q", s)
+	}
+
+	var limits HostLimits
+	var err error
+	if limits.Rate, err = strconv.ParseFloat(values[0], 64); err != nil || limits.Rate < 0 {
+		return "", HostLimits{}, fmt.Errorf("invalid rate in %q", s)
+	}
+	if limits.Burst, err = strconv.Atoi(values[1]); err != nil || limits.Burst < 1 {
+		return "", HostLimits{}, fmt.Errorf("invalid burst in %q", s)
+	}
+	if limits.MaxConns, err = strconv.Atoi(values[2]); err != nil || limits.MaxConns < 0 {
+		return "", HostLimits{}, fmt.Errorf("invalid number of connections in %q", s)
 	}
+	return parts[0], limits, nil
 }
 
-func getHostLimiter(host string) *rate.Limiter {
-	limiter, _ := hostLimiters.LoadOrStore(host, rate.NewLimiter(reqPerSec, burstRate))
-	casted, ok := limiter.(*rate.Limiter)
+// hostGate throttles the requests to a single host
+type hostGate struct {
+	host    string
+	limits  HostLimits
+	limiter *rate.Limiter
+	// one entry per request in flight, nil if unlimited
+	conns chan struct{}
+	// guards changes to the limiter's rate
+	mu      sync.Mutex
+	waiting int32
+	active  int32
+}
+
+func newHostGate(host string) *hostGate {
+	limits, ok := hostLimits[host]
 	if !ok {
-		log.Fatalf("Expected a *rate.Limiter, but was something else")
+		limits = DefaultLimits
+	}
+	g := &hostGate{
+		host:    host,
+		limits:  limits,
+		limiter: rate.NewLimiter(rateLimit(limits.Rate), limits.Burst),
+	}
+	if limits.MaxConns > 0 {
+		g.conns = make(chan struct{}, limits.MaxConns)
+	}
+	return g
+}
+
+func rateLimit(perSec float64) rate.Limit {
+	if perSec <= 0 {
+		return rate.Inf
+	}
+	return rate.Limit(perSec)
+}
+
+func getHostGate(host string) *hostGate {
+	if g, ok := hostGates.Load(host); ok {
+		return g.(*hostGate)
 	}
-	return casted
+	g, _ := hostGates.LoadOrStore(host, newHostGate(host))
+	return g.(*hostGate)
+}
+
+// acquireHost waits until another request to the URL's host is allowed and a
+// connection is free. It returns an error if ctx is done before that.
+// Otherwise release has to be called once the response was read.
+func acquireHost(ctx context.Context, uri string) (*hostGate, error) {
+	g := getHostGate(hostFromUrl(uri))
+	atomic.AddInt32(&g.waiting, 1)
+	defer atomic.AddInt32(&g.waiting, -1)
+
+	if g.conns != nil {
+		select {
+		case g.conns <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if err := g.limiter.Wait(ctx); err != nil {
+		if g.conns != nil {
+			<-g.conns
+		}
+		return nil, err
+	}
+	atomic.AddInt32(&g.active, 1)
+	return g, nil
+}
+
+func (g *hostGate) release() {
+	atomic.AddInt32(&g.active, -1)
+	if g.conns != nil {
+		<-g.conns
+	}
+}
+
+// slowDown halves the rate after the host told us to back off
+func (g *hostGate) slowDown() {
+	if g.limits.Rate <= 0 {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	current := float64(g.limiter.Limit())
+	next := math.Max(current/2, g.limits.Rate*minRateFactor)
+	if next < current {
+		g.limiter.SetLimit(rate.Limit(next))
+		log.Printf("%s is rate limiting, slowing down to %.2f requests/s", g.host, next)
+	}
+}
+
+// speedUp slowly goes back to the configured rate after a successful request
+func (g *hostGate) speedUp() {
+	if g.limits.Rate <= 0 {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	current := float64(g.limiter.Limit())
+	if current < g.limits.Rate {
+		g.limiter.SetLimit(rate.Limit(math.Min(current+g.limits.Rate/recoverySteps, g.limits.Rate)))
+	}
+}
+
+// HostQueue describes the requests to a host
+type HostQueue struct {
+	Host string
+	// requests waiting for the rate limit or a free connection
+	Waiting int
+	// requests in flight
+	Active int
+	// current requests per second, lower than configured after a 429
+	Rate float64
+}
+
+// Queues lists the hosts requested so far, sorted by name
+func Queues() []HostQueue {
+	var queues []HostQueue
+	hostGates.Range(func(_, value interface{}) bool {
+		g := value.(*hostGate)
+		queues = append(queues, HostQueue{
+			Host:    g.host,
+			Waiting: int(atomic.LoadInt32(&g.waiting)),
+			Active:  int(atomic.LoadInt32(&g.active)),
+			Rate:    float64(g.limiter.Limit()),
+		})
+		return true
+	})
+	sort.Slice(queues, func(i, j int) bool { return queues[i].Host < queues[j].Host })
+	return queues
 }
 
 func hostFromUrl(uri string) string {
 	u, err := url.Parse(uri)
 	if err != nil {
-		log.Fatal(err)
+		log.Fatal(redactError(err))
 	}
 	return u.Host
 }
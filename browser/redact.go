@@ -0,0 +1,67 @@
+package browser
+
+import (
+	"errors"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// CredentialParams are query parameters that carry secrets. They are left out
+// of cache keys, so that changing the API key keeps the cache, and they are
+// redacted whenever a URL is logged.
+var CredentialParams = []string{"client_id", "access_token"}
+
+const redacted = "REDACTED"
+
+// normalizeURL removes CredentialParams from the URL and sorts its query
+// parameters, so that equivalent requests share a cache entry
+func normalizeURL(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return uri
+	}
+	query, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return uri
+	}
+	for _, param := range CredentialParams {
+		query.Del(param)
+	}
+	// Encode sorts by key
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// Redact replaces the values of CredentialParams in the URL, so it can be
+// logged. It works on the raw string, so that broken URLs are redacted too.
+func Redact(uri string) string {
+	if len(CredentialParams) == 0 {
+		return uri
+	}
+	quoted := make([]string, len(CredentialParams))
+	for i, param := range CredentialParams {
+		quoted[i] = regexp.QuoteMeta(param)
+	}
+	re := regexp.MustCompile(`([?&](?:` + strings.Join(quoted, "|") + `)=)[^&#]*`)
+	return re.ReplaceAllString(uri, "${1}"+redacted)
+}
+
+// redactError removes secrets from the URL of errors returned by url.Parse
+// and the HTTP client
+func redactError(err error) error {
+	var ue *url.Error
+	if errors.As(err, &ue) {
+		ue.URL = Redact(ue.URL)
+	}
+	return err
+}
+
+// displayURL is the redacted and shortened URL for logs and errors
+func displayURL(uri string) string {
+	uri = Redact(uri)
+	if len(uri) <= 200 {
+		return uri
+	}
+	return uri[0:199] + "…"
+}
@@ -0,0 +1,112 @@
+package browser
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	tests := []struct {
+		uri, want string
+	}{
+		{"https://a.mapillary.com/v3/sequences?client_id=abc&bbox=1,2", "https://a.mapillary.com/v3/sequences?client_id=REDACTED&bbox=1,2"},
+		{"https://graph.mapillary.com/images?fields=id&access_token=MLY|1|x", "https://graph.mapillary.com/images?fields=id&access_token=REDACTED"},
+		{"https://example.com/?access_token=a&client_id=b#top", "https://example.com/?access_token=REDACTED&client_id=REDACTED#top"},
+		// only whole parameter names
+		{"https://example.com/?my_client_id=a", "https://example.com/?my_client_id=a"},
+		{"https://example.com/client_id=a", "https://example.com/client_id=a"},
+		// broken URLs are redacted as well
+		{"https://exa mple.com/%zz?client_id=abc", "https://exa mple.com/%zz?client_id=REDACTED"},
+	}
+	for _, tt := range tests {
+		if got := Redact(tt.uri); got != tt.want {
+			t.Errorf("Redact(%q) is %q, expected %q", tt.uri, got, tt.want)
+		}
+	}
+}
+
+func TestRedactError(t *testing.T) {
+	_, err := url.Parse("https://example.com/%zz?client_id=secret")
+	if err == nil {
+		t.Fatal("Expected the URL to be invalid")
+	}
+	if msg := redactError(err).Error(); strings.Contains(msg, "secret") {
+		t.Errorf("Error %q contains the secret", msg)
+	}
+
+	err = &StatusError{URL: "https://example.com/?access_token=secret", StatusCode: http.StatusNotFound, Status: "404 Not Found"}
+	if msg := err.Error(); strings.Contains(msg, "secret") {
+		t.Errorf("Error %q contains the secret", msg)
+	}
+
+	other := errors.New("client_id=secret")
+	if got := redactError(other); got != other {
+		t.Errorf("Other errors are changed to %v", got)
+	}
+}
+
+func TestNormalizeURL(t *testing.T) {
+	want := "https://example.com/tiles?a=1&b=2"
+	for _, uri := range []string{
+		"https://example.com/tiles?b=2&a=1",
+		"https://example.com/tiles?client_id=one&a=1&b=2",
+		"https://example.com/tiles?a=1&access_token=two&b=2",
+	} {
+		if got := normalizeURL(uri); got != want {
+			t.Errorf("normalizeURL(%q) is %q, expected %q", uri, got, want)
+		}
+		if url2key(uri) != url2key(want) {
+			t.Errorf("%s has a different cache key than %s", uri, want)
+		}
+	}
+}
+
+func TestMigrateLegacyKey(t *testing.T) {
+	old := "https://migrate.invalid/tiles?client_id=old&a=1"
+	current := "https://migrate.invalid/tiles?client_id=new&a=1"
+
+	e := Entry{Header: EntryHeader{Status: http.StatusOK, Length: 11}, Body: []byte("legacy body")}
+	encoded, err := e.encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		raw  []byte
+	}{
+		{"headerless", e.Body},
+		{"with header", encoded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := diskCache.Write(legacyKey(old), tt.raw); err != nil {
+				t.Fatal(err)
+			}
+
+			// the legacy key is only known for the exact URL
+			if _, ok := ReadFromCache(current); ok {
+				t.Errorf("Found an entry for another API key")
+			}
+			got, ok := ReadFromCache(old)
+			if !ok || string(got.Body) != "legacy body" {
+				t.Fatalf("Got %+v, expected the legacy entry", got)
+			}
+			if diskCache.Has(legacyKey(old)) {
+				t.Errorf("Legacy entry was kept")
+			}
+
+			// from now on, any API key finds it
+			got, ok = ReadFromCache(current)
+			if !ok || string(got.Body) != "legacy body" {
+				t.Errorf("Got %+v for another API key, expected the migrated entry", got)
+			}
+			if !got.Header.Legacy && got.Header.URL != "https://migrate.invalid/tiles?a=1" {
+				t.Errorf("Migrated entry has URL %q, expected it without credentials", got.Header.URL)
+			}
+			diskCache.Erase(url2key(current))
+		})
+	}
+}
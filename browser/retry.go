@@ -0,0 +1,123 @@
+package browser
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cenkalti/backoff"
+)
+
+// give up on a URL after this many attempts or this much time, whichever
+// comes first
+const maxAttempts = 8
+const maxRetryTime = 5 * time.Minute
+
+var (
+	ErrNotFound     = errors.New("not found")
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrRateLimited  = errors.New("rate limited")
+)
+
+// StatusError is returned for responses other than 200 OK. Use errors.Is
+// to check for ErrNotFound, ErrUnauthorized and ErrRateLimited.
+type StatusError struct {
+	URL        string
+	StatusCode int
+	Status     string
+	// how long the server asked to wait before retrying, if at all
+	RetryAfter time.Duration
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("Unexpected status: got %v for %s", e.Status, displayURL(e.URL))
+}
+
+func (e *StatusError) Unwrap() error {
+	switch e.StatusCode {
+	case http.StatusNotFound, http.StatusGone:
+		return ErrNotFound
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return ErrUnauthorized
+	case http.StatusTooManyRequests:
+		return ErrRateLimited
+	}
+	return nil
+}
+
+// permanent is true for client errors which won't go away by retrying
+func (e *StatusError) permanent() bool {
+	switch e.StatusCode {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return false
+	}
+	return e.StatusCode >= 400 && e.StatusCode < 500
+}
+
+func newStatusError(url string, res *http.Response) *StatusError {
+	err := &StatusError{URL: url, StatusCode: res.StatusCode, Status: res.Status}
+	if res.StatusCode == http.StatusTooManyRequests || res.StatusCode == http.StatusServiceUnavailable {
+		err.RetryAfter = parseRetryAfter(res.Header.Get("Retry-After"))
+	}
+	return err
+}
+
+// parseRetryAfter reads both the seconds and the HTTP date form
+func parseRetryAfter(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(header); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(header); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+// retryPolicy backs off exponentially, but waits at least as long as the
+// server asked for in its last response
+type retryPolicy struct {
+	backoff.BackOff
+	retryAfter time.Duration
+}
+
+func newRetryPolicy() *retryPolicy {
+	exp := backoff.NewExponentialBackOff()
+	exp.InitialInterval = 5 * time.Second
+	exp.MaxElapsedTime = maxRetryTime
+	return &retryPolicy{BackOff: backoff.WithMaxRetries(exp, maxAttempts-1)}
+}
+
+func (r *retryPolicy) NextBackOff() time.Duration {
+	next := r.BackOff.NextBackOff()
+	if next != backoff.Stop && r.retryAfter > next {
+		next = r.retryAfter
+	}
+	r.retryAfter = 0
+	return next
+}
+
+// classify turns errors that should not be retried into permanent ones and
+// remembers how long the server wants us to wait
+func (r *retryPolicy) classify(err error) error {
+	if errors.Is(err, ErrNotCached) {
+		return backoff.Permanent(err)
+	}
+	var se *StatusError
+	if !errors.As(err, &se) {
+		return err
+	}
+	if se.permanent() {
+		return backoff.Permanent(err)
+	}
+	if se.RetryAfter > maxRetryTime {
+		// not worth waiting for
+		return backoff.Permanent(err)
+	}
+	r.retryAfter = se.RetryAfter
+	return err
+}
@@ -0,0 +1,155 @@
+package browser
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cenkalti/backoff"
+)
+
+func TestStatusError(t *testing.T) {
+	tests := []struct {
+		status    int
+		want      error
+		permanent bool
+	}{
+		{http.StatusNotFound, ErrNotFound, true},
+		{http.StatusGone, ErrNotFound, true},
+		{http.StatusUnauthorized, ErrUnauthorized, true},
+		{http.StatusForbidden, ErrUnauthorized, true},
+		{http.StatusTooManyRequests, ErrRateLimited, false},
+		{http.StatusBadRequest, nil, true},
+		{http.StatusRequestTimeout, nil, false},
+		{http.StatusInternalServerError, nil, false},
+		{http.StatusServiceUnavailable, nil, false},
+	}
+	for _, tt := range tests {
+		err := &StatusError{URL: "https://example.com/", StatusCode: tt.status}
+		for _, sentinel := range []error{ErrNotFound, ErrUnauthorized, ErrRateLimited} {
+			if got := errors.Is(err, sentinel); got != (sentinel == tt.want) {
+				t.Errorf("%d: errors.Is(%v) is %v", tt.status, sentinel, got)
+			}
+		}
+		if got := err.permanent(); got != tt.permanent {
+			t.Errorf("%d: permanent is %v, expected %v", tt.status, got, tt.permanent)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		header   string
+		min, max time.Duration
+	}{
+		{"", 0, 0},
+		{"120", 2 * time.Minute, 2 * time.Minute},
+		{"0", 0, 0},
+		{"-5", 0, 0},
+		{"soon", 0, 0},
+		{time.Now().Add(time.Hour).UTC().Format(http.TimeFormat), 59 * time.Minute, time.Hour},
+	}
+	for _, tt := range tests {
+		if got := parseRetryAfter(tt.header); got < tt.min || got > tt.max {
+			t.Errorf("parseRetryAfter(%q) is %v, expected %v to %v", tt.header, got, tt.min, tt.max)
+		}
+	}
+}
+
+func TestNewStatusErrorRetryAfter(t *testing.T) {
+	for status, want := range map[int]time.Duration{
+		http.StatusTooManyRequests:     30 * time.Second,
+		http.StatusServiceUnavailable:  30 * time.Second,
+		http.StatusInternalServerError: 0,
+	} {
+		res := &http.Response{StatusCode: status, Header: http.Header{"Retry-After": {"30"}}}
+		if got := newStatusError("https://example.com/", res).RetryAfter; got != want {
+			t.Errorf("%d: Retry-After is %v, expected %v", status, got, want)
+		}
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	policy := newRetryPolicy()
+	permanent := func(err error) bool {
+		var p *backoff.PermanentError
+		return errors.As(err, &p)
+	}
+
+	tests := []struct {
+		name      string
+		err       error
+		permanent bool
+	}{
+		{"network", errors.New("connection reset"), false},
+		{"server error", &StatusError{StatusCode: http.StatusBadGateway}, false},
+		{"rate limited", &StatusError{StatusCode: http.StatusTooManyRequests, RetryAfter: time.Minute}, false},
+		{"not found", &StatusError{StatusCode: http.StatusNotFound}, true},
+		{"wrapped not found", fmt.Errorf("tile: %w", &StatusError{StatusCode: http.StatusNotFound}), true},
+		{"too long to wait", &StatusError{StatusCode: http.StatusServiceUnavailable, RetryAfter: time.Hour}, true},
+		{"not cached", fmt.Errorf("%w: https://example.com/", ErrNotCached), true},
+	}
+	for _, tt := range tests {
+		if got := permanent(policy.classify(tt.err)); got != tt.permanent {
+			t.Errorf("%s: permanent is %v, expected %v", tt.name, got, tt.permanent)
+		}
+	}
+
+	// the server's wish outweighs the exponential backoff, but only once
+	policy = newRetryPolicy()
+	policy.classify(&StatusError{StatusCode: http.StatusTooManyRequests, RetryAfter: 2 * time.Minute})
+	if got := policy.NextBackOff(); got != 2*time.Minute {
+		t.Errorf("First backoff is %v, expected the 2m from Retry-After", got)
+	}
+	if got := policy.NextBackOff(); got >= 2*time.Minute {
+		t.Errorf("Second backoff is %v, expected the exponential one", got)
+	}
+
+	policy = newRetryPolicy()
+	for i := 1; i < maxAttempts; i++ {
+		if got := policy.NextBackOff(); got == backoff.Stop {
+			t.Fatalf("Gave up after %d attempts, expected %d", i, maxAttempts)
+		}
+	}
+	if got := policy.NextBackOff(); got != backoff.Stop {
+		t.Errorf("Backoff after %d attempts is %v, expected to give up", maxAttempts, got)
+	}
+}
+
+func TestGetDoesNotRetryClientErrors(t *testing.T) {
+	srv, requests := countingServer(func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	})
+	defer srv.Close()
+
+	_, err := Get(context.Background(), srv.URL+"/missing")
+	var se *StatusError
+	if !errors.As(err, &se) || !errors.Is(err, ErrNotFound) {
+		t.Errorf("Got error %v, expected a StatusError for not found", err)
+	}
+	if n := atomic.LoadInt32(requests); n != 1 {
+		t.Errorf("Sent %d requests, expected 1", n)
+	}
+}
+
+func TestGetStopsWhenCancelled(t *testing.T) {
+	srv, _ := countingServer(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	defer srv.Close()
+
+	// a deadline before the next attempt would make it give up right away
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	if _, err := Get(ctx, srv.URL+"/unavailable"); !errors.Is(err, context.Canceled) {
+		t.Errorf("Got error %v, expected the context's", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("Took %v to give up, expected to stop waiting once cancelled", d)
+	}
+}
@@ -0,0 +1,140 @@
+package browser
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// cacheFile is where the entry for the URL is stored
+func cacheFile(uri string) string {
+	return filepath.Join(append([]string{basePath}, strings.Split(url2key(uri), "__")...)...)
+}
+
+// validatingServer answers with the current body and the validator of the
+// given kind. Requests with a matching validator get 304 Not Modified.
+type validatingServer struct {
+	mu      sync.Mutex
+	body    string
+	version int
+	// the conditional headers of each request
+	conditions []string
+}
+
+func (v *validatingServer) handler(w http.ResponseWriter, r *http.Request) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	etag := fmt.Sprintf(`"v%d"`, v.version)
+	modified := time.Date(2020, 6, v.version+1, 10, 0, 0, 0, time.UTC).Format(http.TimeFormat)
+	inm, ims := r.Header.Get("If-None-Match"), r.Header.Get("If-Modified-Since")
+	v.conditions = append(v.conditions, inm+ims)
+
+	if strings.HasSuffix(r.URL.Path, "/etag") {
+		w.Header().Set("ETag", etag)
+		if inm == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	} else {
+		w.Header().Set("Last-Modified", modified)
+		if ims == modified {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	w.Write([]byte(v.body))
+}
+
+func TestRevalidation(t *testing.T) {
+	defer func(ttl time.Duration) { TTL = ttl }(TTL)
+	TTL = time.Millisecond
+
+	for _, validator := range []string{"etag", "modified"} {
+		t.Run(validator, func(t *testing.T) {
+			v := &validatingServer{body: "first"}
+			srv, _ := countingServer(v.handler)
+			defer srv.Close()
+			url := srv.URL + "/" + validator
+			get := func(want string) {
+				t.Helper()
+				time.Sleep(2 * TTL)
+				if body, err := Get(context.Background(), url); err != nil || body != want {
+					t.Errorf("Got %q (%v), expected %q", body, err, want)
+				}
+			}
+
+			get("first")
+			first, _ := ReadFromCache(url)
+
+			// unchanged, so the cached body is used and counts as fresh again
+			get("first")
+			second, _ := ReadFromCache(url)
+			if !second.Header.Fetched.After(first.Header.Fetched) {
+				t.Errorf("Revalidated entry was fetched at %v, expected after %v", second.Header.Fetched, first.Header.Fetched)
+			}
+
+			v.mu.Lock()
+			v.body, v.version = "second", 1
+			v.mu.Unlock()
+			get("second")
+
+			v.mu.Lock()
+			defer v.mu.Unlock()
+			if len(v.conditions) != 3 || v.conditions[0] != "" || v.conditions[1] == "" || v.conditions[1] != v.conditions[2] {
+				t.Errorf("Sent conditions %q, expected none at first and then the first validator twice", v.conditions)
+			}
+		})
+	}
+}
+
+func TestStaleWithoutValidator(t *testing.T) {
+	defer func(ttl time.Duration) { TTL = ttl }(TTL)
+	TTL = time.Millisecond
+
+	srv, requests := countingServer(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Modified-Since") != "" {
+			t.Errorf("Sent a conditional request without a validator")
+		}
+		w.Write([]byte("body"))
+	})
+	defer srv.Close()
+
+	for i := 0; i < 2; i++ {
+		time.Sleep(2 * TTL)
+		if _, err := Get(context.Background(), srv.URL+"/plain"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt32(requests); n != 2 {
+		t.Errorf("Sent %d requests, expected the stale entry to be fetched again", n)
+	}
+}
+
+func TestExpireKeepsRevalidatable(t *testing.T) {
+	plain := "https://expire.invalid/plain"
+	etag := "https://expire.invalid/etag"
+	WriteToCache(plain, Entry{Header: EntryHeader{Status: http.StatusOK}, Body: []byte("plain")})
+	WriteToCache(etag, Entry{Header: EntryHeader{Status: http.StatusOK, ETag: `"v0"`}, Body: []byte("etag")})
+
+	// everything is older than that
+	Expire(-time.Minute, true)
+	if _, err := os.Stat(cacheFile(plain)); !os.IsNotExist(err) {
+		t.Errorf("Entry without validator was kept")
+	}
+	if _, err := os.Stat(cacheFile(etag)); err != nil {
+		t.Errorf("Entry with ETag was removed: %v", err)
+	}
+
+	Expire(-time.Minute, false)
+	if _, err := os.Stat(cacheFile(etag)); !os.IsNotExist(err) {
+		t.Errorf("Entry with ETag was kept, although revalidation is off")
+	}
+}
@@ -2,6 +2,7 @@ package cheapruler
 
 import (
 	"log"
+	"math"
 
 	cheapruler "github.com/JamesMilnerUK/cheap-ruler-go"
 	"github.com/paulmach/orb"
@@ -9,12 +10,19 @@ import (
 
 var sharedCr cheapruler.CheapRuler
 var crInitialized = false
+var crLat float64
 
+// Init sets up the ruler for distances around the given latitude. It may
+// only be called again for the same latitude.
 func Init(lat float64) {
 	if crInitialized {
+		if lat == crLat {
+			return
+		}
 		log.Fatalf("Cheapruler was already initialized!")
 	}
 	crInitialized = true
+	crLat = lat
 
 	cr, err := cheapruler.NewCheapruler(lat, "meters")
 	if err != nil {
@@ -42,14 +50,55 @@ func LineDist(ls orb.LineString, pt orb.Point) float64 {
 	return sharedCr.Distance(toFloat(pt), pol.Point)
 }
 
+// BearingAlong returns the direction of the line string's segment closest to
+// the given point. Line strings with fewer than two points have no direction,
+// so it returns NaN for them.
+func BearingAlong(ls orb.LineString, pt orb.Point) float64 {
+	if !crInitialized {
+		log.Fatalf("Cheapruler not initialized!")
+	}
+	if len(ls) < 2 {
+		return math.NaN()
+	}
+
+	fls := toFloatLs(ls)
+	idx := sharedCr.PointOnLine(fls, toFloat(pt)).Index
+	if idx >= len(fls)-1 {
+		idx = len(fls) - 2
+	}
+	return sharedCr.Bearing(fls[idx], fls[idx+1])
+}
+
+// DistAlong returns how far along the line string the point closest to the
+// given one is, measured from the line string's start
+func DistAlong(ls orb.LineString, pt orb.Point) float64 {
+	if !crInitialized {
+		log.Fatalf("Cheapruler not initialized!")
+	}
+
+	fls := toFloatLs(ls)
+	pol := sharedCr.PointOnLine(fls, toFloat(pt))
+	return sharedCr.LineDistance(fls[:pol.Index+1]) + sharedCr.Distance(fls[pol.Index], pol.Point)
+}
+
 // emits a Point every interval <unit of sharedCr> along the line string
 func EveryN(ls orb.LineString, interval float64) []orb.Point {
+	out, _ := EveryNAlong(ls, interval)
+	return out
+}
+
+// EveryNAlong is like EveryN, but also returns how far along the line string
+// each point is. Unlike DistAlong, this stays correct for tracks that pass
+// the same spot twice, e.g. round trips.
+func EveryNAlong(ls orb.LineString, interval float64) ([]orb.Point, []float64) {
 	if interval <= 0 {
 		log.Fatalf("interval must be positive")
 	}
 
 	out := make([]orb.Point, 0)
+	along := make([]float64, 0)
 	out = append(out, ls[0])
+	along = append(along, 0)
 
 	step := 0.0
 	currentPos := 0.0
@@ -59,6 +108,12 @@ func EveryN(ls orb.LineString, interval float64) []orb.Point {
 		p1 := toFloat(ls[i+1])
 		d := sharedCr.Distance(p0, p1)
 
+		// repeated points, nothing to interpolate
+		if d == 0 {
+			i++
+			continue
+		}
+
 		if currentPos+d < interval*step {
 			currentPos += d
 			i++
@@ -66,11 +121,13 @@ func EveryN(ls orb.LineString, interval float64) []orb.Point {
 		}
 
 		out = append(out, interpolate(p0, p1, (interval*step-currentPos)/d))
+		along = append(along, interval*step)
 		step++
 	}
 
 	out = append(out, ls[len(ls)-1])
-	return out
+	along = append(along, currentPos)
+	return out, along
 }
 
 func toFloat(pt orb.Point) []float64 {
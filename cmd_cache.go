@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/breunigs/photoepics/browser"
+	"github.com/spf13/cobra"
+)
+
+func cmdCache() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "cache",
+		Short: "Inspects and cleans up the cache of downloaded Mapillary responses.",
+		// don't expire automatically, so that stats show what's really there
+		PersistentPreRun: func(cmd *cobra.Command, args []string) {},
+	}
+	cmd.AddCommand(cmdCacheStats())
+	cmd.AddCommand(cmdCacheExpire())
+	cmd.AddCommand(cmdCacheClear())
+	cmd.AddCommand(cmdCacheGet())
+	return cmd
+}
+
+func cmdCacheStats() *cobra.Command {
+	return &cobra.Command{
+		Use:   "stats",
+		Short: "Shows how many entries the cache has, by host and age.",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			stats := browser.Stats()
+			fmt.Printf("%d entries, %s\n", stats.Entries, formatBytes(stats.Bytes))
+
+			hosts := make([]string, 0, len(stats.Hosts))
+			for host := range stats.Hosts {
+				hosts = append(hosts, host)
+			}
+			sort.Strings(hosts)
+			fmt.Println("\nHOST                                ENTRIES        SIZE")
+			for _, host := range hosts {
+				h := stats.Hosts[host]
+				fmt.Printf("%-35s %8d %11s\n", host, h.Entries, formatBytes(h.Bytes))
+			}
+
+			fmt.Println("\nAGE            ENTRIES")
+			for i, count := range stats.Ages {
+				label := "older"
+				if i < len(browser.AgeBuckets) {
+					label = "< " + formatAge(browser.AgeBuckets[i])
+				}
+				fmt.Printf("%-12s %9d\n", label, count)
+			}
+		},
+	}
+}
+
+func cmdCacheExpire() *cobra.Command {
+	var olderThan time.Duration
+	var keepRevalidatable bool
+
+	cmd := &cobra.Command{
+		Use:   "expire",
+		Short: "Removes old entries from the cache.",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			log.Printf("Expired %d entries", browser.Expire(olderThan, keepRevalidatable))
+		},
+	}
+	cmd.Flags().DurationVar(&olderThan, "older-than", browser.DefaultTTL, "remove entries older than this, e.g. 72h")
+	cmd.Flags().BoolVar(&keepRevalidatable, "keep-revalidatable", false, "keep entries with an ETag or Last-Modified date, since they can be refreshed cheaply")
+	return cmd
+}
+
+func cmdCacheClear() *cobra.Command {
+	var host string
+
+	cmd := &cobra.Command{
+		Use:   "clear",
+		Short: "Removes all entries from the cache, or only those of one host.",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			log.Printf("Removed %d entries", browser.Clear(host))
+		},
+	}
+	cmd.Flags().StringVar(&host, "host", "", "only remove entries for this host, e.g. graph.mapillary.com")
+	return cmd
+}
+
+func cmdCacheGet() *cobra.Command {
+	var headers bool
+
+	cmd := &cobra.Command{
+		Use:   "get <url>",
+		Short: "Prints the cached response for the URL.",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			entry, ok := browser.ReadFromCache(args[0])
+			if !ok {
+				log.Fatalf("%s is not cached", browser.Redact(args[0]))
+			}
+			if headers {
+				printEntryHeader(entry.Header)
+			}
+			os.Stdout.Write(entry.Body)
+		},
+	}
+	cmd.Flags().BoolVar(&headers, "headers", false, "also print when and how the response was fetched, to stderr")
+	return cmd
+}
+
+func printEntryHeader(h browser.EntryHeader) {
+	if h.Legacy {
+		fmt.Fprintln(os.Stderr, "Written by an older version, no details known")
+		return
+	}
+	fmt.Fprintf(os.Stderr, "URL:           %s\n", h.URL)
+	fmt.Fprintf(os.Stderr, "Fetched:       %s\n", h.Fetched.Format(time.RFC3339))
+	fmt.Fprintf(os.Stderr, "Status:        %d\n", h.Status)
+	fmt.Fprintf(os.Stderr, "Content-Type:  %s\n", h.ContentType)
+	fmt.Fprintf(os.Stderr, "ETag:          %s\n", h.ETag)
+	fmt.Fprintf(os.Stderr, "Last-Modified: %s\n", h.LastModified)
+	fmt.Fprintf(os.Stderr, "Length:        %d\n", h.Length)
+	fmt.Fprintf(os.Stderr, "Truncated:     %t\n\n", h.Truncated)
+}
+
+// cacheMaxSize configures the automatic cleanup before each command
+var cacheMaxSize int64
+
+func cacheFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().DurationVar(&browser.TTL, "cache-ttl", browser.DefaultTTL, "ask the server again for cached responses older than this. Those that cannot be revalidated are removed on start. 0 keeps them forever.")
+	cmd.PersistentFlags().Int64Var(&cacheMaxSize, "cache-max-size", 2048, "remove the oldest cached responses on start until the cache takes at most this many MiB. 0 disables the limit.")
+	cmd.PersistentFlags().BoolVar(&browser.Offline, "offline", false, "only use cached responses, even outdated ones, and never access the network. Lists the missing responses if there are any.")
+	cmd.PersistentFlags().BoolVar(&browser.Refresh, "refresh", false, "ignore cached responses and download everything again. The cache is still updated.")
+}
+
+func cleanupCache() {
+	if browser.Offline && browser.Refresh {
+		log.Fatal("--offline and --refresh cannot be used together")
+	}
+	if browser.Offline {
+		// expired responses are better than none when they can't be downloaded
+		return
+	}
+	if browser.TTL > 0 {
+		if n := browser.Expire(browser.TTL, true); n > 0 {
+			log.Printf("Expired %d cached responses", n)
+		}
+	}
+	if cacheMaxSize > 0 {
+		if n := browser.EnforceSizeCap(cacheMaxSize * 1024 * 1024); n > 0 {
+			log.Printf("Removed %d cached responses to stay below %d MiB", n, cacheMaxSize)
+		}
+	}
+}
+
+func formatBytes(b int64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%d B", b)
+	}
+	div, exp := int64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(b)/float64(div), "KMGTPE"[exp])
+}
+
+func formatAge(d time.Duration) string {
+	days := int(d / (24 * time.Hour))
+	if days == 1 {
+		return "1 day"
+	}
+	return fmt.Sprintf("%d days", days)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/breunigs/photoepics/cheapruler"
+	"github.com/breunigs/photoepics/mapillary"
+	"github.com/breunigs/photoepics/store"
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+	"github.com/spf13/cobra"
+)
+
+func cmdCoverage() *cobra.Command {
+	var session string
+	var step float64
+	var radius float64
+	var minPhotos int
+	var format string
+
+	cmd := &cobra.Command{
+		Use:   "coverage",
+		Short: "Lists stretches of the loaded track without usable images.",
+		Long:  "Walks along the loaded track and lists the stretches where there are not enough images nearby that face along the track. Useful to find out where new sequences need to be captured.",
+		Run: func(cmd *cobra.Command, args []string) {
+			runCmdCoverage(cmd.Context(), session, step, radius, minPhotos, format)
+		},
+	}
+
+	sessionFlag(&session, cmd)
+	cmd.Flags().Float64Var(&step, "step", 10, "distance in meters between the points along the track that are checked")
+	cmd.Flags().Float64Var(&radius, "radius", mapillary.SearchRadius, "how far in meters images may be from a point to cover it")
+	cmd.Flags().IntVar(&minPhotos, "min-photos", 1, "how many images facing along the track are needed to cover a point")
+	cmd.Flags().StringVar(&format, "format", "text", "output format. One of: text, geojson")
+
+	return cmd
+}
+
+// gap is a stretch along the track without enough images
+type gap struct {
+	// distances along the track in meters
+	start, end float64
+	line       orb.LineString
+}
+
+func runCmdCoverage(ctx context.Context, session string, step, radius float64, minPhotos int, format string) {
+	if step <= 0 || radius <= 0 {
+		log.Fatalf("--step and --radius must be positive")
+	}
+	if format != "text" && format != "geojson" {
+		log.Fatalf("Unknown output format %q, expected one of: text, geojson", format)
+	}
+
+	db := openStore(ctx)
+	defer db.Close()
+
+	sess, exists := db.Session(session)
+	if !exists {
+		log.Fatalf("There is no session %q in the database. Did you run the load command? Known sessions: %s", session, strings.Join(db.Sessions(), ", "))
+	}
+	cheapruler.Init(sess.Track[0][1])
+
+	gaps, length := findGaps(db, sess, step, radius, minPhotos)
+
+	var uncovered float64
+	for _, g := range gaps {
+		uncovered += g.end - g.start
+	}
+	// a track of zero length has no gaps either
+	percent := 0.0
+	if length > 0 {
+		percent = 100 * uncovered / length
+	}
+	log.Printf("Found %d gaps, %.0fm of %.0fm (%.1f%%) are not covered", len(gaps), uncovered, length, percent)
+
+	var err error
+	if format == "geojson" {
+		err = writeGapsGeoJSON(os.Stdout, gaps)
+	} else {
+		err = writeGapsText(os.Stdout, gaps)
+	}
+	if err != nil {
+		log.Fatalf("Failed to write gaps: %+v", err)
+	}
+}
+
+// findGaps checks points every step meters along the track and joins
+// consecutive uncovered ones. Each point stands for the track up to halfway
+// to its neighbours, so a single uncovered point is a gap of about step
+// meters. It also returns the length of the track.
+func findGaps(db store.Store, sess store.Session, step, radius float64, minPhotos int) ([]gap, float64) {
+	pts, along := cheapruler.EveryNAlong(sess.Track, step)
+
+	var gaps []gap
+	var current *gap
+	for i, pt := range pts {
+		if countFacing(db, sess, pt, radius) >= minPhotos {
+			current = nil
+			continue
+		}
+
+		from, to := along[i], along[i]
+		if i > 0 {
+			from = (along[i-1] + along[i]) / 2
+		}
+		if i < len(pts)-1 {
+			to = (along[i] + along[i+1]) / 2
+		}
+		if current == nil {
+			gaps = append(gaps, gap{start: from})
+			current = &gaps[len(gaps)-1]
+		}
+		current.end = to
+		current.line = append(current.line, pt)
+	}
+	return gaps, along[len(along)-1]
+}
+
+// countFacing returns how many images near the given point face along the
+// track
+func countFacing(db store.Store, sess store.Session, pt orb.Point, radius float64) int {
+	bearing := cheapruler.BearingAlong(sess.Track, pt)
+	count := 0
+	for _, p := range db.PhotosNear(sess.Name, pt, radius) {
+		if p.AngleDiff(bearing) <= maxEndpointAngle {
+			count++
+		}
+	}
+	return count
+}
+
+func writeGapsText(w io.Writer, gaps []gap) error {
+	fmt.Fprintln(w, "START (m)   END (m)  LENGTH (m)  FROM                     TO")
+	for _, g := range gaps {
+		from := g.line[0]
+		to := g.line[len(g.line)-1]
+		_, err := fmt.Fprintf(w, "%9.0f %9.0f %11.0f  %10.6f,%-10.6f  %10.6f,%-10.6f\n",
+			g.start, g.end, g.end-g.start, from[0], from[1], to[0], to[1])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeGapsGeoJSON(w io.Writer, gaps []gap) error {
+	fc := geojson.NewFeatureCollection()
+	for _, g := range gaps {
+		var geom orb.Geometry = g.line
+		if len(g.line) == 1 {
+			geom = g.line[0]
+		}
+		f := geojson.NewFeature(geom)
+		f.Properties["start"] = g.start
+		f.Properties["end"] = g.end
+		f.Properties["length"] = g.end - g.start
+		fc.Append(f)
+	}
+
+	out, err := json.MarshalIndent(fc, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", out)
+	return err
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/breunigs/photoepics/cheapruler"
+	"github.com/breunigs/photoepics/mapillary"
+	"github.com/breunigs/photoepics/memory"
+	"github.com/breunigs/photoepics/store"
+	"github.com/paulmach/orb"
+)
+
+func TestFindGaps(t *testing.T) {
+	// about 100m towards the east
+	track := orb.LineString{{13.3777, 52.5165}, {13.3792, 52.5165}}
+	cheapruler.Init(track[0][1])
+	const step = 10
+	pts, along := cheapruler.EveryNAlong(track, step)
+
+	tests := []struct {
+		name string
+		// indices of the points along the track without a photo
+		holes []int
+		want  []gap
+	}{
+		{"covered", nil, nil},
+		{"one point", []int{5}, []gap{{start: along[5] - step/2, end: along[5] + step/2}}},
+		{"two points", []int{5, 6}, []gap{{start: along[5] - step/2, end: along[6] + step/2}}},
+		// the track's end is less than a step after the last point
+		{"end", []int{len(pts) - 2, len(pts) - 1}, []gap{{start: (along[len(pts)-3] + along[len(pts)-2]) / 2, end: along[len(pts)-1]}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := memory.New("")
+			sess := store.Session{Name: "test", Track: track}
+			db.CreateSession(sess)
+
+			var photos []*mapillary.Photo
+			for i, pt := range pts {
+				if contains(tt.holes, i) {
+					continue
+				}
+				p := &mapillary.Photo{Key: fmt.Sprintf("photo%d", i), CameraAngle: 90}
+				p.SetLocation(pt)
+				photos = append(photos, p)
+			}
+			db.InsertPhotos(sess.Name, photos)
+
+			gaps, length := findGaps(db, sess, step, 4, 1)
+			if math.Abs(length-along[len(along)-1]) > 1e-9 {
+				t.Errorf("Track is %.1fm long, expected %.1fm", length, along[len(along)-1])
+			}
+			if len(gaps) != len(tt.want) {
+				t.Fatalf("Found %d gaps, expected %d: %+v", len(gaps), len(tt.want), gaps)
+			}
+			for i, g := range gaps {
+				w := tt.want[i]
+				if math.Abs(g.start-w.start) > 1e-9 || math.Abs(g.end-w.end) > 1e-9 {
+					t.Errorf("Gap %d goes from %.1fm to %.1fm, expected %.1fm to %.1fm", i, g.start, g.end, w.start, w.end)
+				}
+			}
+		})
+	}
+}
+
+func TestWriteGapsGeoJSON(t *testing.T) {
+	gaps := []gap{
+		{start: 5, end: 15, line: orb.LineString{{13.3778, 52.5165}}},
+		{start: 35, end: 55, line: orb.LineString{{13.3781, 52.5165}, {13.3783, 52.5165}}},
+	}
+	var buf bytes.Buffer
+	if err := writeGapsGeoJSON(&buf, gaps); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, want := range []string{`"type": "Point"`, `"type": "LineString"`, `"length": 10`, `"length": 20`} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Output does not contain %s:\n%s", want, out)
+		}
+	}
+}
+
+func contains(list []int, x int) bool {
+	for _, y := range list {
+		if x == y {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/breunigs/photoepics/mapillary/fake"
+	"github.com/spf13/cobra"
+)
+
+func cmdFakeMapillary() *cobra.Command {
+	var fixtures string
+	var listen string
+
+	cmd := &cobra.Command{
+		Use:   "fake-mapillary",
+		Short: "Serves a fake Mapillary API from fixture files.",
+		Long:  "Serves the parts of Mapillary's v3 and v4 APIs that the load command uses from fixture files, so that it can be run offline. The fixture directory needs a " + fake.SequencesFile + " and an " + fake.ImagesFile + ".",
+		Run: func(cmd *cobra.Command, args []string) {
+			runCmdFakeMapillary(fixtures, listen)
+		},
+	}
+	cmd.Flags().StringVar(&fixtures, "fixtures", "mapillary/fake/fixtures", "directory with the fixture files")
+	cmd.Flags().StringVar(&listen, "listen", "localhost:8090", "address to listen on")
+
+	return cmd
+}
+
+func runCmdFakeMapillary(fixtures, listen string) {
+	f, err := fake.Load(fixtures)
+	if err != nil {
+		log.Fatalf("Failed to load fixtures from %s: %+v", fixtures, err)
+	}
+
+	conf := fake.Config("http://"+listen, "v4")
+	log.Printf("Listening on %s. Use it with:", listen)
+	log.Printf("  load --api-key fake --tiles-url %s --graph-url %s", conf.TilesBaseURL, conf.GraphBaseURL)
+	log.Printf("  load --api-key fake --api v3 --v3-url %s", conf.BaseURL)
+	log.Fatal(http.ListenAndServe(listen, f.Handler()))
+}
@@ -1,44 +1,80 @@
 package main
 
 import (
+	"context"
 	"log"
+	"strings"
 
+	"github.com/breunigs/photoepics/browser"
 	"github.com/breunigs/photoepics/cheapruler"
-	"github.com/breunigs/photoepics/dgraph"
 	"github.com/breunigs/photoepics/edge"
 	"github.com/breunigs/photoepics/mapillary"
+	"github.com/breunigs/photoepics/store"
 	"github.com/spf13/cobra"
 )
 
 func cmdLoad() *cobra.Command {
 	var inputFilePath string
 	var mapConf mapillary.Config
-	var trackID int
+	var trackOpts trackOptions
+	var session string
+	var resume bool
+	var proxy, caBundle string
 
 	cmd := &cobra.Command{
 		Use:   "load",
 		Short: "Loads images along the given file. Also calculates desirability for the images it finds.",
 		Run: func(cmd *cobra.Command, args []string) {
-			runCmdLoad(mapConf, inputFilePath, trackID)
+			useHTTPClient(&mapConf, proxy, caBundle)
+			runCmdLoad(cmd.Context(), mapConf, inputFilePath, trackOpts, session, resume)
 		},
 	}
-	cmd.Flags().StringVarP(&inputFilePath, "input", "i", "", "input file for which to generate a photo sequence")
+	cmd.Flags().StringVarP(&inputFilePath, "input", "i", "", "input file for which to generate a photo sequence. One of: GPX, GeoJSON, KML, KMZ, FIT, TCX.")
 	cmd.MarkFlagRequired("input")
 	requireAPIKey(&mapConf, cmd)
+	chooseAPI(&mapConf, cmd)
 	filterByUserName(&mapConf, cmd)
 	filterByDate(&mapConf, cmd)
-	cmd.Flags().IntVarP(&trackID, "track", "", -1, "If the input file has more than one track, use this to specify the index of the desired one. It will be ignored if there is only one track.")
+	httpClientFlags(&proxy, &caBundle, cmd)
+	trackFlags(&trackOpts, cmd)
+	cmd.Flags().StringVar(&trackOpts.selector, "track", "", "If the input file has more than one track, use this to specify the desired one by index, name or glob pattern like 'Ring*'. An index will be ignored if there is only one track. With --track-where, only matching tracks are counted. \"all\" merges all tracks into one. A track whose name equals the value exactly is preferred over all of these.")
+	cmd.Flags().StringVar(&trackOpts.mergeOrder, "merge-order", "file", "how to order the tracks for --track all. One of: "+strings.Join(mergeOrders, ", ")+". nearest follows each track with the one whose start or end is closest.")
+	sessionFlag(&session, cmd)
+	cmd.Flags().BoolVar(&resume, "resume", false, "continue an aborted load of the given session, skipping tiles and steps that were already completed")
 
 	return cmd
 }
 
-func runCmdLoad(mapConf mapillary.Config, inputFilePath string, trackID int) {
-	db := dgraph.NewClient()
+func runCmdLoad(ctx context.Context, mapConf mapillary.Config, inputFilePath string, trackOpts trackOptions, session string, resume bool) {
+	if mapConf.API != "v4" && mapConf.API != "v3" {
+		log.Fatalf("Unknown Mapillary API %q, expected one of: v4, v3", mapConf.API)
+	}
+	if err := store.CheckSessionName(session); err != nil {
+		log.Fatal(err)
+	}
 
-	if mapillary.PhotoCount(db) > 0 {
-		log.Fatalf("Tried to load data, but database is not empty. This will lead to wrong results since the entries depend on the given input file. Please purge the DB.")
+	db := openStore(ctx)
+
+	_, exists := db.Session(session)
+	if exists && !resume {
+		log.Fatalf("Tried to load data into session %q, but it already exists. Since the entries depend on the given input file, please purge the session or choose a different name. If a previous load was aborted, use --resume to continue it.", session)
 	}
-	downloadAlong(mapConf, db, inputFilePath, trackID)
+	downloadAlong(ctx, mapConf, db, session, inputFilePath, trackOpts, exists)
+	db.Close()
+
+	if missing := browser.MissingURLs(); len(missing) > 0 {
+		log.Fatalf("%d responses are not cached, so they cannot be read with --offline:\n  %s\nRun again with --resume when online to load the rest.", len(missing), strings.Join(missing, "\n  "))
+	}
+}
+
+// trackFlags configure which tracks are read from the input file
+func trackFlags(opts *trackOptions, cmd *cobra.Command) {
+	cmd.Flags().StringVar(&opts.where, "track-where", "", "only consider tracks with this property, e.g. name=Ring. GeoJSON properties can be used, for other files only the name.")
+	cmd.Flags().BoolVar(&opts.joinSegments, "join-segments", false, "treat the segments of a GPX track as one track with gaps, instead of offering each on its own")
+}
+
+func sessionFlag(session *string, cmd *cobra.Command) {
+	cmd.Flags().StringVar(session, "session", "default", "name of the loaded route. Multiple sessions can be kept in the database at the same time.")
 }
 
 func requireAPIKey(mapConf *mapillary.Config, cmd *cobra.Command) {
@@ -46,6 +82,31 @@ func requireAPIKey(mapConf *mapillary.Config, cmd *cobra.Command) {
 	cmd.MarkFlagRequired("api-key")
 }
 
+func chooseAPI(mapConf *mapillary.Config, cmd *cobra.Command) {
+	cmd.Flags().StringVar(&mapConf.API, "api", "v4", "Mapillary API version to use. One of: v4, v3. v3 has been retired by Mapillary and only works with a cache or a fake server.")
+	cmd.Flags().StringVar(&mapConf.BaseURL, "v3-url", "", "base URL of the v3 API. Defaults to Mapillary's servers.")
+	cmd.Flags().StringVar(&mapConf.TilesBaseURL, "tiles-url", "", "base URL of the v4 coverage tiles. Defaults to Mapillary's servers.")
+	cmd.Flags().StringVar(&mapConf.GraphBaseURL, "graph-url", "", "base URL of the v4 Graph API. Defaults to Mapillary's servers.")
+}
+
+func httpClientFlags(proxy *string, caBundle *string, cmd *cobra.Command) {
+	cmd.Flags().StringVar(proxy, "proxy", "", "send requests through this proxy, e.g. http://proxy.example.com:3128. Defaults to the HTTPS_PROXY environment variable.")
+	cmd.Flags().StringVar(caBundle, "ca-bundle", "", "PEM file with additional certificates to trust, e.g. for a proxy that intercepts TLS")
+}
+
+// useHTTPClient makes mapConf read through the browser with a client for the
+// given proxy and CA bundle, if any were set
+func useHTTPClient(mapConf *mapillary.Config, proxy string, caBundle string) {
+	if proxy == "" && caBundle == "" {
+		return
+	}
+	client, err := browser.NewHTTPClient(proxy, caBundle)
+	if err != nil {
+		log.Fatal(err)
+	}
+	mapConf.Fetcher = browser.Browser{Client: client}
+}
+
 func filterByUserName(mapConf *mapillary.Config, cmd *cobra.Command) {
 	cmd.Flags().StringVarP(&mapConf.FilterUsers, "filter-users", "", "", "only use photos from these Mapillary users. Comma separated.")
 }
@@ -54,24 +115,54 @@ func filterByDate(mapConf *mapillary.Config, cmd *cobra.Command) {
 	cmd.Flags().StringVarP(&mapConf.FilterNewer, "filter-newer", "", "", "only use sequences newer than this date. Format YYYY-MM-DD.")
 }
 
-func downloadAlong(mapConf mapillary.Config, db dgraph.Wrapper, inputFilePath string, trackID int) {
-	lineStr, err := trackFromFile(inputFilePath, trackID)
+func downloadAlong(ctx context.Context, mapConf mapillary.Config, db store.Store, session string, inputFilePath string, trackOpts trackOptions, resume bool) {
+	t, err := trackFromFile(inputFilePath, trackOpts)
 	if err != nil {
 		log.Fatalf("Cannot extract GPS track from file: %+v", err)
 	}
+	lineStr := t.line
+	if len(lineStr) < 2 {
+		log.Fatalf("The track has %d points, but at least two are needed to tell its direction", len(lineStr))
+	}
 	cheapruler.Init(lineStr[0][1])
+	logTrackDetails(t)
 
-	insertChan := make(chan dgraph.DgraphInsertable, 50)
-	go func() {
-		defer close(insertChan)
-		photoChan := mapillary.FindSequences(mapConf, lineStr)
-		for x := range photoChan {
-			insertChan <- x
+	db.CreateSchema()
+	if resume {
+		prev, _ := db.Session(session)
+		if !prev.Track.Equal(lineStr) {
+			log.Fatalf("Cannot resume session %q, it was started with a different track.", session)
 		}
-	}()
+		log.Printf("Resuming session %s", session)
+	} else {
+		db.CreateSession(store.Session{Name: session, Track: lineStr})
+	}
+	cp := store.NewCheckpoint(db, session)
+
+	photoChan, err := mapillary.FindSequences(ctx, mapConf, lineStr, cp)
+	if err != nil {
+		log.Fatalf("Cannot load photos: %v", err)
+	}
+	store.InsertPhotoStream(db, session, photoChan, cp)
+	if ctx.Err() != nil {
+		log.Printf("Stopped loading photos. Use --resume to continue.")
+		return
+	}
+	if len(browser.MissingURLs()) > 0 {
+		// weights would be calculated for only some of the photos
+		return
+	}
 
-	db.CreateSchema(mapillary.PhotoDgraphSchema())
-	db.InsertStream(insertChan)
+	store.InsertEdgeStream(db, session, edge.CalcWeightsAlong(ctx, db, session, lineStr, mapillary.SearchRadius, cp), cp)
+	if ctx.Err() != nil {
+		log.Printf("Stopped calculating weights. Use --resume to continue.")
+	}
+}
 
-	db.InsertStream(edge.CalcWeightsAlong(db, lineStr, 25))
+// logTrackDetails reports the gaps between joined segments or tracks
+func logTrackDetails(t track) {
+	for _, idx := range t.gaps {
+		from, to := t.line[idx-1], t.line[idx]
+		log.Printf("Gap of %.0f m at %.1f km, bridged with a straight line", cheapruler.Dist(from[:], to[:]), cheapruler.DistAlong(t.line, from)/1000)
+	}
 }
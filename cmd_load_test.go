@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/breunigs/photoepics/mapillary/fake"
+)
+
+const fixtures = "mapillary/fake/fixtures"
+
+func TestLoadAndQuery(t *testing.T) {
+	f, err := fake.Load(fixtures)
+	if err != nil {
+		t.Fatalf("Failed to load fixtures: %v", err)
+	}
+	dir, err := ioutil.TempDir("", "photoepics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	storeBackend = "memory"
+	storePath = filepath.Join(dir, "epic.gob")
+	conf := fake.Config("http://fake.invalid", "v4")
+	conf.Fetcher = f.Fetcher()
+	runCmdLoad(context.Background(), conf, filepath.Join(fixtures, "track.geojson"), trackOptions{}, "test", false)
+
+	// query reads what load saved
+	db := openStore(context.Background())
+	defer db.Close()
+	sess, ok := db.Session("test")
+	if !ok {
+		t.Fatalf("Session was not saved")
+	}
+	if got, want := db.PhotoCount(), int64(len(f.Photos())); got != want {
+		t.Errorf("Loaded %d photos, expected %d", got, want)
+	}
+	if db.EdgeCount("test") == 0 {
+		t.Fatalf("No edges were calculated")
+	}
+
+	start := resolveEndpoint(db, sess, endpoint{}, sess.Track[0], "start")
+	end := resolveEndpoint(db, sess, endpoint{}, sess.Track[len(sess.Track)-1], "end")
+	paths := db.ShortestPaths("test", start, end, 1, 0.5)
+	if len(paths) != 1 {
+		t.Fatalf("Found %d chains, expected 1", len(paths))
+	}
+
+	photos := paths[0].Photos
+	if photos[0].Key != start.Key || photos[len(photos)-1].Key != end.Key {
+		t.Errorf("Chain goes from %s to %s, expected %s to %s", photos[0].Key, photos[len(photos)-1].Key, start.Key, end.Key)
+	}
+	// the fixtures' two sequences each cover half of the track
+	if segs := segments(photos); len(segs) != 2 {
+		t.Errorf("Chain has %d segments, expected 2: %+v", len(segs), segs)
+	}
+}
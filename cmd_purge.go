@@ -4,20 +4,26 @@ import (
 	"log"
 	"sync"
 
-	"github.com/breunigs/photoepics/dgraph"
-	"github.com/breunigs/photoepics/edge"
-	"github.com/breunigs/photoepics/mapillary"
+	"github.com/breunigs/photoepics/store"
 	"github.com/spf13/cobra"
 )
 
 var purgeConfirmed bool
 
 func cmdPurge() *cobra.Command {
+	var session string
+
 	cmd := &cobra.Command{
 		Use:   "purge",
-		Short: "Deletes EVERYTHING from DB",
+		Short: "Deletes EVERYTHING from DB, or only the given session",
 		Run: func(cmd *cobra.Command, args []string) {
-			db := dgraph.NewClient()
+			db := openStore(cmd.Context())
+			defer db.Close()
+
+			if session != "" {
+				purgeSession(db, session)
+				return
+			}
 
 			log.Printf("Purging…")
 			db.PurgeEverything()
@@ -26,17 +32,31 @@ func cmdPurge() *cobra.Command {
 			wg.Add(2)
 			go func() {
 				defer wg.Done()
-				log.Printf("Photos: %d", mapillary.PhotoCount(db))
+				log.Printf("Photos: %d", db.PhotoCount())
 			}()
 			go func() {
 				defer wg.Done()
-				log.Printf("Edges: %d", edge.Count(db))
+				log.Printf("Sessions: %d", len(db.Sessions()))
 			}()
 			wg.Wait()
 		},
 	}
 	cmd.Flags().BoolVarP(&purgeConfirmed, "confirm", "", false, "Please confirm that you really want to delete everything in the database")
 	cmd.MarkFlagRequired("confirm")
+	cmd.Flags().StringVar(&session, "session", "", "only delete this session's track, distances and edges. Photos are kept, since other sessions might use them.")
 
 	return cmd
 }
+
+func purgeSession(db store.Store, session string) {
+	if err := store.CheckSessionName(session); err != nil {
+		log.Fatal(err)
+	}
+	if _, exists := db.Session(session); !exists {
+		log.Fatalf("There is no session %q in the database", session)
+	}
+
+	log.Printf("Purging session %s…", session)
+	db.DeleteSession(session)
+	log.Printf("Edges: %d", db.EdgeCount(session))
+}
@@ -1,100 +1,164 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
 	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
 
-	"github.com/breunigs/photoepics/dgraph"
-	"github.com/breunigs/photoepics/edge"
+	"github.com/breunigs/photoepics/cheapruler"
 	"github.com/breunigs/photoepics/mapillary"
+	"github.com/breunigs/photoepics/store"
+	"github.com/paulmach/orb"
 	"github.com/spf13/cobra"
 )
 
-const emptyImageKey = "           ?          "
-
 func cmdQuery() *cobra.Command {
 	var startImageKey string
 	var endImageKey string
+	var startPoint string
+	var endPoint string
+	var session string
+	var alternatives int
+	var maxOverlap float64
+	var format string
 
 	cmd := &cobra.Command{
 		Use:   "query",
 		Short: "Attempts to find path between two images.",
+		Long:  "Attempts to find path between two images. Start and end can be given as image keys or coordinates. If neither is given, the first and last point of the loaded track are used.",
 		Run: func(cmd *cobra.Command, args []string) {
-			runCmdQuery(startImageKey, endImageKey)
+			runCmdQuery(cmd.Context(), session, endpoint{startImageKey, startPoint}, endpoint{endImageKey, endPoint}, alternatives, maxOverlap, format)
 		},
 	}
 
 	cmd.Flags().StringVar(&startImageKey, "start-image", "", "The image to start from")
-	cmd.MarkFlagRequired("start-image")
 	cmd.Flags().StringVar(&endImageKey, "end-image", "", "The image to stop at")
-	cmd.MarkFlagRequired("end-image")
+	cmd.Flags().StringVar(&startPoint, "start-point", "", "Start from the best fitting image near these coordinates. Format: lon,lat")
+	cmd.Flags().StringVar(&endPoint, "end-point", "", "Stop at the best fitting image near these coordinates. Format: lon,lat")
+	sessionFlag(&session, cmd)
+	cmd.Flags().IntVar(&alternatives, "alternatives", 1, "how many different chains to find")
+	cmd.Flags().Float64Var(&maxOverlap, "max-overlap", 50, "percentage of images between start and end an alternative chain may share with a better one")
+	cmd.Flags().StringVar(&format, "format", "text", "output format. One of: "+strings.Join(chainFormats(), ", "))
 
 	return cmd
 }
 
-type shortestPath struct {
-	Path []mapillary.Photo
+// endpoint is where a chain should start or end, either given by an image key
+// or by coordinates
+type endpoint struct {
+	imageKey string
+	point    string
 }
 
-func runCmdQuery(startImageKey, endImageKey string) {
-	db := dgraph.NewClient()
+func runCmdQuery(ctx context.Context, session string, start, end endpoint, alternatives int, maxOverlap float64, format string) {
+	if alternatives < 1 {
+		log.Fatalf("Need to find at least one chain, but --alternatives was %d", alternatives)
+	}
+	if _, ok := chainWriters[format]; !ok {
+		log.Fatalf("Unknown output format %q, expected one of: %s", format, strings.Join(chainFormats(), ", "))
+	}
 
-	startPic := mapillary.PhotoByKey(db, startImageKey)
-	endPic := mapillary.PhotoByKey(db, endImageKey)
+	db := openStore(ctx)
+	defer db.Close()
 
-	if mapillary.PhotoCount(db) == 0 || edge.Count(db) == 0 {
+	sess, exists := db.Session(session)
+	if !exists {
+		log.Fatalf("There is no session %q in the database. Did you run the load command? Known sessions: %s", session, strings.Join(db.Sessions(), ", "))
+	}
+	if len(sess.Track) < 2 {
+		log.Fatalf("The track of session %q has %d points, but at least two are needed to tell its direction", session, len(sess.Track))
+	}
+	cheapruler.Init(sess.Track[0][1])
+
+	if db.PhotoCount() == 0 || db.EdgeCount(session) == 0 {
 		log.Fatalf("Hmm, there are no photos or edges in the database. Did you run the load command?")
 	}
 
-	resp := db.Query(`
-         {
-           path as shortest(from: `+startPic.Uid+`, to: `+endPic.Uid+`, numpaths: 1) {
-             transitionable @facets(weight)
-           }
-           path(func: uid(path)) { `+mapillary.PhotoReadQueryBody+` }
-         }`,
-		map[string]string{})
-
-	var r shortestPath
-	if err := json.Unmarshal(resp, &r); err != nil {
-		log.Fatal(err)
-	}
-
-	// full list
-	fmt.Println("\n\nDB UID     SEQUENCE KEY             IMAGE KEY")
-	for _, pic := range r.Path {
-		fmt.Printf("(%s) %s:  %s\n", pic.Uid, pic.Sequence, pic.Key)
-	}
-
-	// abbreviated
-	fmt.Println("\n\nSummarized")
-	prevSeq := ""
-	seqStart := emptyImageKey
-	seqEnd := emptyImageKey
-	first := true
-	for _, pic := range r.Path {
-		if prevSeq == pic.Sequence {
-			seqEnd = pic.Key
-			continue
+	startPic := resolveEndpoint(db, sess, start, sess.Track[0], "start")
+	endPic := resolveEndpoint(db, sess, end, sess.Track[len(sess.Track)-1], "end")
+
+	paths := db.ShortestPaths(session, startPic, endPic, alternatives, maxOverlap/100)
+	if len(paths) == 0 {
+		log.Fatalf("There is no chain between %s and %s", startPic.Key, endPic.Key)
+	}
+	if len(paths) < alternatives {
+		log.Printf("Only found %d sufficiently different chains", len(paths))
+	}
+
+	if err := writeChains(os.Stdout, format, paths); err != nil {
+		log.Fatalf("Failed to write chains: %+v", err)
+	}
+}
+
+func resolveEndpoint(db store.Store, sess store.Session, ep endpoint, fallback orb.Point, which string) mapillary.Photo {
+	if ep.imageKey != "" {
+		return db.PhotoByKey(ep.imageKey)
+	}
+
+	pt := fallback
+	if ep.point != "" {
+		var err error
+		pt, err = parsePoint(ep.point)
+		if err != nil {
+			log.Fatalf("Cannot use --%s-point: %+v", which, err)
 		}
+	}
+
+	pic, ok := bestPhotoNear(db, sess, pt)
+	if !ok {
+		log.Fatalf("Could not find any image facing along the track within %.0fm of %f,%f to %s at", photoSearchRadii[len(photoSearchRadii)-1], pt[0], pt[1], which)
+	}
+	log.Printf("Chain will %s at image %s (%.0fm from %f,%f)", which, pic.Key, cheapruler.Dist(pic.Loc.Coords, []float64{pt[0], pt[1]}), pt[0], pt[1])
+	return pic
+}
+
+// search radii in meters when looking for images close to a given point
+var photoSearchRadii = []float64{10, 25, 50, 100, 200}
+
+// images which look further away from the track's direction are not used
+const maxEndpointAngle = 45
 
-		if prevSeq != "" {
-			lineEnd := "\n"
-			if seqStart == seqEnd {
-				if first {
-					seqStart = emptyImageKey
-				} else {
-					lineEnd = " // single image\n"
-				}
+// bestPhotoNear finds the closest photo to the given point that faces along
+// the session's track
+func bestPhotoNear(db store.Store, sess store.Session, pt orb.Point) (mapillary.Photo, bool) {
+	bearing := cheapruler.BearingAlong(sess.Track, pt)
+	center := []float64{pt[0], pt[1]}
+
+	for _, radius := range photoSearchRadii {
+		var best mapillary.Photo
+		bestDist := math.Inf(1)
+		for _, p := range db.PhotosNear(sess.Name, pt, radius) {
+			if p.AngleDiff(bearing) > maxEndpointAngle {
+				continue
+			}
+			if dist := cheapruler.Dist(center, p.Loc.Coords); dist < bestDist {
+				best = p
+				bestDist = dist
 			}
-			first = false
-			fmt.Print(`{ "seq": "` + prevSeq + `", "from": "` + seqStart + `", "to": "` + seqEnd + `" },` + lineEnd)
 		}
+		if !math.IsInf(bestDist, 1) {
+			return best, true
+		}
+	}
+	return mapillary.Photo{}, false
+}
 
-		prevSeq = pic.Sequence
-		seqStart = pic.Key
-		seqEnd = seqStart
+func parsePoint(lonLat string) (orb.Point, error) {
+	parts := strings.Split(lonLat, ",")
+	if len(parts) != 2 {
+		return orb.Point{}, fmt.Errorf("expected lon,lat but got %q", lonLat)
+	}
+	lon, err := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	if err != nil {
+		return orb.Point{}, fmt.Errorf("invalid longitude in %q: %v", lonLat, err)
+	}
+	lat, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	if err != nil {
+		return orb.Point{}, fmt.Errorf("invalid latitude in %q: %v", lonLat, err)
 	}
-	fmt.Println(`{ "seq": "` + prevSeq + `", "from": "` + seqStart + `", "to": "` + emptyImageKey + `" },`)
+	return orb.Point{lon, lat}, nil
 }
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/spf13/cobra"
+)
+
+func cmdTracks() *cobra.Command {
+	var opts trackOptions
+
+	cmd := &cobra.Command{
+		Use:   "tracks <file>",
+		Short: "Lists the tracks in the file, e.g. to pick one for load --track.",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			tracks, err := tracksFromFile(args[0], opts)
+			if err != nil {
+				log.Fatalf("Cannot extract GPS tracks from file: %+v", err)
+			}
+			writeTracks(tracks)
+		},
+	}
+	trackFlags(&opts, cmd)
+	return cmd
+}
+
+func writeTracks(tracks []track) {
+	fmt.Printf("%3s  %-30s %7s %10s  %s\n", "#", "NAME", "POINTS", "LENGTH", "BOUNDING BOX (lon/lat)")
+	for idx, t := range tracks {
+		b := t.line.Bound()
+		fmt.Printf("%3d  %-30s %7d %7.1f km  %.5f,%.5f,%.5f,%.5f\n", idx, t.name, len(t.line), t.lengthKm(), b.Min.Lon(), b.Min.Lat(), b.Max.Lon(), b.Max.Lat())
+	}
+}
@@ -4,8 +4,8 @@ import (
 	"context"
 	"encoding/json"
 	"log"
+	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/dgraph-io/dgo"
@@ -19,11 +19,17 @@ type DgraphInsertable interface {
 	DgraphInsert() string
 }
 
+// Wrapper runs queries and mutations against Dgraph. They are cancelled once
+// its context is done, e.g. on Ctrl-C, which ends the program. Every
+// mutation is a transaction of its own, so a cancelled one is discarded as a
+// whole.
 type Wrapper struct {
+	conn   *grpc.ClientConn
 	client *dgo.Dgraph
+	ctx    context.Context
 }
 
-func NewClient() Wrapper {
+func NewClient(ctx context.Context) Wrapper {
 	d, err := grpc.Dial("localhost:9080", grpc.WithInsecure())
 	if err != nil {
 		log.Fatal(err)
@@ -34,7 +40,23 @@ func NewClient() Wrapper {
 	)
 
 	return Wrapper{
+		conn:   d,
 		client: client,
+		ctx:    ctx,
+	}
+}
+
+// exitIfInterrupted ends the program if the failure was caused by the
+// cancelled context, instead of retrying
+func (w Wrapper) exitIfInterrupted() {
+	if w.ctx.Err() != nil {
+		log.Fatalf("Interrupted, the Dgraph transaction in flight was discarded. A load can be continued with --resume.")
+	}
+}
+
+func (w Wrapper) Close() {
+	if err := w.conn.Close(); err != nil {
+		log.Printf("Failed to close connection to Dgraph: %+v", err)
 	}
 }
 
@@ -62,8 +84,9 @@ func (w Wrapper) Count(predicate string) int64 {
 func (w Wrapper) Query(query string, params map[string]string) []byte {
 	var lastError error
 	for i := 0; i < maxRetries; i++ {
-		resp, err := w.client.NewTxn().QueryWithVars(context.Background(), query, params)
+		resp, err := w.client.NewTxn().QueryWithVars(w.ctx, query, params)
 		if err != nil {
+			w.exitIfInterrupted()
 			lastError = err
 			log.Println("retrying query")
 			time.Sleep(time.Second)
@@ -76,76 +99,142 @@ func (w Wrapper) Query(query string, params map[string]string) []byte {
 }
 
 func (w Wrapper) CreateSchema(schema string) {
-	err := w.client.Alter(context.Background(), &api.Operation{
+	err := w.client.Alter(w.ctx, &api.Operation{
 		Schema: schema,
 	})
 	if err != nil {
+		w.exitIfInterrupted()
 		log.Fatalf("cannot create schema: %+v\n\nSchema was:\n%s", err, schema)
 	}
 }
 
 func (w Wrapper) PurgeEverything() {
-	err := w.client.Alter(context.Background(), &api.Operation{
+	err := w.client.Alter(w.ctx, &api.Operation{
 		DropAll: true,
 	})
 	if err != nil {
+		w.exitIfInterrupted()
 		log.Fatalf("Failed to purge everything: %s", err)
 	}
 }
 
-func (w Wrapper) insertStr(entry string) {
+func (w Wrapper) DropPredicate(predicate string) {
+	err := w.client.Alter(w.ctx, &api.Operation{
+		DropAttr: predicate,
+	})
+	if err != nil {
+		w.exitIfInterrupted()
+		log.Fatalf("Failed to drop predicate %s: %s", predicate, err)
+	}
+}
+
+func (w Wrapper) mutate(mu *api.Mutation, entry string) {
 	for i := 1; i <= maxRetries; i++ {
-		mu := &api.Mutation{
-			CommitNow: true,
-			SetNquads: []byte(entry),
-		}
-		_, err := w.client.NewTxn().Mutate(context.Background(), mu)
+		_, err := w.client.NewTxn().Mutate(w.ctx, mu)
 		if err == nil {
 			return
 		}
+		w.exitIfInterrupted()
 
 		if i != maxRetries && strings.Index(err.Error(), "Transaction has been aborted") >= 0 {
 			time.Sleep(1 * time.Second)
 			continue
 		}
 
-		log.Fatalf("Failed to insert entry into DB: %+v\n\nOriginal query was:\n%s", err, entry)
+		log.Fatalf("Failed to mutate DB: %+v\n\nOriginal query was:\n%s", err, entry)
 	}
 }
 
-func (w Wrapper) Insert(entry DgraphInsertable) {
-	w.insertStr(entry.DgraphInsert())
+func (w Wrapper) insertStr(entry string) {
+	w.mutate(&api.Mutation{
+		CommitNow: true,
+		SetNquads: []byte(entry),
+	}, entry)
 }
 
-func (w Wrapper) InsertBatch(entries []DgraphInsertable) {
-	var b strings.Builder
-	for _, entry := range entries {
-		b.WriteString(entry.DgraphInsert())
+func (w Wrapper) Delete(entry string) {
+	w.mutate(&api.Mutation{
+		CommitNow: true,
+		DelNquads: []byte(entry),
+	}, entry)
+}
+
+// Upsert looks up the nodes which have one of the given values for the
+// predicate, and then inserts the N-Quads built from the found uids within
+// the same transaction. Values without a node are missing from the map. The
+// predicate should have the @upsert directive, so that concurrent upserts
+// for the same value abort and are retried.
+func (w Wrapper) Upsert(predicate string, values []string, nquads func(uids map[string]string) string) {
+	quoted := make([]string, len(values))
+	for i, v := range values {
+		quoted[i] = strconv.Quote(v)
+	}
+	query := `{
+    nodes(func: eq(<` + predicate + `>, [` + strings.Join(quoted, ", ") + `])) {
+      uid
+      value: <` + predicate + `>
+    }
+  }`
+
+	var entry string
+	for i := 1; i <= maxRetries; i++ {
+		var err error
+		entry, err = w.tryUpsert(query, nquads)
+		if err == nil {
+			return
+		}
+		w.exitIfInterrupted()
+
+		if i != maxRetries && strings.Index(err.Error(), "Transaction has been aborted") >= 0 {
+			time.Sleep(1 * time.Second)
+			continue
+		}
+
+		log.Fatalf("Failed to upsert into DB: %+v\n\nOriginal query was:\n%s\n\nwith mutation:\n%s", err, query, entry)
 	}
-	w.insertStr(b.String())
 }
 
-func (w Wrapper) InsertStream(stream <-chan DgraphInsertable) {
-	var b strings.Builder
+type upsertRoot struct {
+	Nodes []struct {
+		Uid   string `json:"uid"`
+		Value string `json:"value"`
+	} `json:"nodes"`
+}
 
-	i := 0
+func (w Wrapper) tryUpsert(query string, nquads func(uids map[string]string) string) (string, error) {
+	ctx := w.ctx
+	txn := w.client.NewTxn()
+	defer txn.Discard(ctx)
 
-	var wg sync.WaitGroup
-	for entry := range stream {
-		i++
-		b.WriteString(entry.DgraphInsert())
-		if i == 50 {
-			i = 0
-			wg.Add(1)
-			go func(query string) {
-				defer wg.Done()
-				w.insertStr(query)
-			}(b.String())
-			b.Reset()
+	resp, err := txn.Query(ctx, query)
+	if err != nil {
+		return "", err
+	}
+
+	var r upsertRoot
+	if err := json.Unmarshal(resp.GetJson(), &r); err != nil {
+		return "", err
+	}
+	uids := make(map[string]string, len(r.Nodes))
+	for _, n := range r.Nodes {
+		// in case there are already duplicates, keep using the first one
+		if _, ok := uids[n.Value]; !ok {
+			uids[n.Value] = n.Uid
 		}
 	}
-	if i > 0 {
-		w.insertStr(b.String())
+
+	entry := nquads(uids)
+	_, err = txn.Mutate(ctx, &api.Mutation{SetNquads: []byte(entry)})
+	if err != nil {
+		return entry, err
 	}
-	wg.Wait()
+	return entry, txn.Commit(ctx)
+}
+
+func (w Wrapper) InsertBatch(entries []DgraphInsertable) {
+	var b strings.Builder
+	for _, entry := range entries {
+		b.WriteString(entry.DgraphInsert())
+	}
+	w.insertStr(b.String())
 }
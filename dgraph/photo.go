@@ -0,0 +1,124 @@
+package dgraph
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+
+	"github.com/breunigs/photoepics/mapillary"
+	"github.com/paulmach/orb"
+)
+
+type root struct {
+	Photos []mapillary.Photo `json:"photos"`
+}
+
+const photoReadQueryBody = `
+  uid
+  key
+  loc
+  sequence
+  cameraAngle
+  mergeCC
+  captured
+`
+
+// distance from path is stored per session, but read into the same field
+func photoReadQuery(session string) string {
+	return photoReadQueryBody + "  distFromPath: <" + distPredicate(session) + ">\n"
+}
+
+func distPredicate(session string) string {
+	return "distFromPath." + session
+}
+
+const photoSchema = `
+    key: string @index(exact) @upsert .
+    loc: geo @index(geo) .
+    orgLoc: geo .
+    sequence: string .
+    cameraAngle: float .
+    orgCameraAngle: float .
+    mergeCC: int .
+    captured: dateTime .
+  `
+
+type photo struct {
+	*mapillary.Photo
+	session string
+}
+
+func (p photo) IRIKey() string {
+	k := strings.Replace(p.Key, "-", "ü", -1)
+	return strings.Replace(k, "_", "Ö", -1)
+}
+
+// nquads sets all fields of the photo on the given node, which is either an
+// existing uid in angle brackets or a blank node.
+func (p photo) nquads(k string) string {
+	return fmt.Sprintf(`
+    `+k+` <loc> "{'type':'Point','coordinates':[%f,%f]}"^^<geo:geojson> .
+    `+k+` <orgLoc> "{'type':'Point','coordinates':[%f,%f]}"^^<geo:geojson> .
+    `+k+` <key> "%s" .
+    `+k+` <sequence> "%s" .
+    `+k+` <cameraAngle> "%f" .
+    `+k+` <orgCameraAngle> "%f" .
+    `+k+` <mergeCC> "%d" .
+    `+k+` <captured> "%s" .
+    `+k+` <`+distPredicate(p.session)+`> "%f" .
+  `,
+		p.Loc.Coords[0], p.Loc.Coords[1],
+		p.OrgLoc.Coords[0], p.OrgLoc.Coords[1],
+		p.Key, p.Sequence, p.CameraAngle, p.OrgCameraAngle, p.MergeCC, p.RFC3339(), p.DistFromPath)
+}
+
+func photoCount(w Wrapper) int64 {
+	cnt := float64(w.Count("key"))
+	cnt = math.Max(cnt, float64(w.Count("loc")))
+	return int64(cnt)
+}
+
+func photoByKey(w Wrapper, key string) mapillary.Photo {
+	query := `query PhotoByKey($key: string) {
+    photos(func: eq(key, $key)) { ` + photoReadQueryBody + ` }
+  }`
+	params := map[string]string{
+		"$key": key,
+	}
+	resp := w.Query(query, params)
+
+	var r root
+	if err := json.Unmarshal(resp, &r); err != nil {
+		log.Fatal(err)
+	}
+
+	if len(r.Photos) != 1 {
+		log.Fatalf("Expected to find exactly one photo with key=%s, but found %d", key, len(r.Photos))
+	}
+
+	return r.Photos[0]
+}
+
+func photosNear(w Wrapper, session string, pt orb.Point, radius float64) []mapillary.Photo {
+	query := `
+    query PhotosNear($loc: string, $radius: float) {
+      photos(func: near(loc, $loc, $radius) ) @filter(has(<` + distPredicate(session) + `>)) {
+        ` + photoReadQuery(session) + `
+      }
+    }`
+	params := map[string]string{
+		"$loc":    fmt.Sprintf("[%f, %f]", pt[0], pt[1]),
+		"$radius": fmt.Sprintf("%f", radius),
+	}
+
+	resp := w.Query(query, params)
+
+	var r root
+	if err := json.Unmarshal(resp, &r); err != nil {
+		log.Fatal(err)
+	}
+
+	return r.Photos
+}
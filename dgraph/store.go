@@ -0,0 +1,303 @@
+package dgraph
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/breunigs/photoepics/mapillary"
+	"github.com/breunigs/photoepics/store"
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+)
+
+const sessionSchema = `
+    session: string @index(exact) .
+    track: string .
+    done: [string] .
+  `
+
+// Store implements store.Store on top of a Dgraph cluster
+type Store struct {
+	w Wrapper
+}
+
+// NewStore connects to Dgraph. Its queries and mutations are cancelled once
+// ctx is done.
+func NewStore(ctx context.Context) Store {
+	return Store{w: NewClient(ctx)}
+}
+
+type edge struct {
+	store.Edge
+	session string
+}
+
+func (e edge) DgraphInsert() string {
+	return fmt.Sprintf("<%s> <%s> <%s> (weight=%f) .\n", e.From, edgePredicate(e.session), e.To, e.Weight)
+}
+
+func edgePredicate(session string) string {
+	return "transitionable." + session
+}
+
+type sessionNode struct {
+	Uid     string   `json:"uid"`
+	Session string   `json:"session"`
+	Track   string   `json:"track"`
+	Done    []string `json:"done"`
+}
+
+type sessionRoot struct {
+	Sessions []sessionNode `json:"sessions"`
+}
+
+// how many candidates to ask Dgraph for per requested alternative
+const alternativeCandidates = 10
+
+type shortestPath struct {
+	Paths []map[string]json.RawMessage `json:"_path_"`
+	Path  []mapillary.Photo            `json:"path"`
+}
+
+func (s Store) CreateSchema() {
+	s.w.CreateSchema(photoSchema + sessionSchema)
+}
+
+func (s Store) findSessions(name string) []sessionNode {
+	query := `query Sessions($name: string) {
+    sessions(func: eq(session, $name)) { uid session track done }
+  }`
+	resp := s.w.Query(query, map[string]string{"$name": name})
+
+	var r sessionRoot
+	if err := json.Unmarshal(resp, &r); err != nil {
+		log.Fatal(err)
+	}
+	return r.Sessions
+}
+
+func (s Store) CreateSession(sess store.Session) {
+	if err := store.CheckSessionName(sess.Name); err != nil {
+		log.Fatal(err)
+	}
+
+	track, err := geojson.NewGeometry(sess.Track).MarshalJSON()
+	if err != nil {
+		log.Fatalf("Failed to encode track of session %s: %+v", sess.Name, err)
+	}
+
+	s.w.CreateSchema(`
+    <` + distPredicate(sess.Name) + `>: float .
+    <` + edgePredicate(sess.Name) + `>: uid .
+  `)
+
+	node := "_:session"
+	if existing := s.findSessions(sess.Name); len(existing) > 0 {
+		node = "<" + existing[0].Uid + ">"
+	}
+	s.w.insertStr(fmt.Sprintf("%s <session> %s .\n%s <track> %s .\n",
+		node, strconv.Quote(sess.Name), node, strconv.Quote(string(track))))
+}
+
+func (s Store) Session(name string) (store.Session, bool) {
+	found := s.findSessions(name)
+	if len(found) == 0 {
+		return store.Session{}, false
+	}
+
+	g, err := geojson.UnmarshalGeometry([]byte(found[0].Track))
+	if err != nil {
+		log.Fatalf("Failed to decode track of session %s: %+v", name, err)
+	}
+	track, ok := g.Geometry().(orb.LineString)
+	if !ok {
+		log.Fatalf("Track of session %s is a %s, not a LineString", name, g.Type)
+	}
+	return store.Session{Name: name, Track: track}, true
+}
+
+func (s Store) Sessions() []string {
+	resp := s.w.Query(`{ sessions(func: has(session), orderasc: session) { session } }`, map[string]string{})
+
+	var r sessionRoot
+	if err := json.Unmarshal(resp, &r); err != nil {
+		log.Fatal(err)
+	}
+
+	names := make([]string, len(r.Sessions))
+	for i, sess := range r.Sessions {
+		names[i] = sess.Session
+	}
+	return names
+}
+
+func (s Store) DeleteSession(name string) {
+	if err := store.CheckSessionName(name); err != nil {
+		log.Fatal(err)
+	}
+
+	s.w.DropPredicate(distPredicate(name))
+	s.w.DropPredicate(edgePredicate(name))
+	for _, sess := range s.findSessions(name) {
+		s.w.Delete("<" + sess.Uid + "> * * .\n")
+	}
+}
+
+func (s Store) MarkDone(session string, steps []string) {
+	found := s.findSessions(session)
+	if len(found) == 0 {
+		log.Fatalf("Session %q does not exist", session)
+	}
+
+	var b strings.Builder
+	for _, step := range steps {
+		fmt.Fprintf(&b, "<%s> <done> %s .\n", found[0].Uid, strconv.Quote(step))
+	}
+	s.w.insertStr(b.String())
+}
+
+func (s Store) DoneSteps(session string) map[string]bool {
+	done := make(map[string]bool)
+	for _, sess := range s.findSessions(session) {
+		for _, step := range sess.Done {
+			done[step] = true
+		}
+	}
+	return done
+}
+
+// InsertPhotos updates photos that already exist (by key) and creates the
+// others, so that loading overlapping routes doesn't produce duplicates.
+func (s Store) InsertPhotos(session string, photos []*mapillary.Photo) {
+	keys := make([]string, len(photos))
+	for i, p := range photos {
+		keys[i] = p.Key
+	}
+
+	s.w.Upsert("key", keys, func(uids map[string]string) string {
+		var b strings.Builder
+		for _, p := range photos {
+			pic := photo{p, session}
+			if uid, ok := uids[p.Key]; ok {
+				b.WriteString(pic.nquads("<" + uid + ">"))
+			} else {
+				b.WriteString(pic.nquads("_:" + pic.IRIKey()))
+			}
+		}
+		return b.String()
+	})
+}
+
+func (s Store) PhotoByKey(key string) mapillary.Photo {
+	return photoByKey(s.w, key)
+}
+
+func (s Store) PhotosNear(session string, pt orb.Point, radius float64) []mapillary.Photo {
+	return photosNear(s.w, session, pt, radius)
+}
+
+func (s Store) PhotoCount() int64 {
+	return photoCount(s.w)
+}
+
+func (s Store) InsertEdges(session string, edges []store.Edge) {
+	entries := make([]DgraphInsertable, len(edges))
+	for i, e := range edges {
+		entries[i] = edge{e, session}
+	}
+	s.w.InsertBatch(entries)
+}
+
+func (s Store) EdgeCount(session string) int64 {
+	return s.w.Count(edgePredicate(session))
+}
+
+func (s Store) ShortestPaths(session string, from, to mapillary.Photo, n int, maxOverlap float64) []store.Path {
+	// Dgraph's k shortest paths tend to be very similar, so ask for more
+	// and only keep the ones that differ enough
+	numpaths := n
+	if n > 1 {
+		numpaths = n * alternativeCandidates
+	}
+
+	pred := edgePredicate(session)
+	resp := s.w.Query(`
+         {
+           path as shortest(from: `+from.Uid+`, to: `+to.Uid+`, numpaths: `+strconv.Itoa(numpaths)+`) {
+             <`+pred+`> @facets(weight)
+           }
+           path(func: uid(path)) { `+photoReadQuery(session)+` }
+         }`,
+		map[string]string{})
+
+	var r shortestPath
+	if err := json.Unmarshal(resp, &r); err != nil {
+		log.Fatal(err)
+	}
+
+	candidates := make([]store.UidPath, len(r.Paths))
+	for i, p := range r.Paths {
+		candidates[i] = parsePath(p, pred)
+	}
+
+	byUid := make(map[string]mapillary.Photo, len(r.Path))
+	for _, p := range r.Path {
+		byUid[p.Uid] = p
+	}
+
+	var paths []store.Path
+	for _, c := range store.DiversePaths(candidates, n, maxOverlap) {
+		photos := make([]mapillary.Photo, len(c.Uids))
+		for i, uid := range c.Uids {
+			photos[i] = byUid[uid]
+		}
+		paths = append(paths, store.Path{Photos: photos, Cost: c.Cost})
+	}
+	return paths
+}
+
+// parsePath reads the nested structure in _path_, where each node contains
+// its successor under the predicate name
+func parsePath(node map[string]json.RawMessage, pred string) store.UidPath {
+	var path store.UidPath
+	if raw, ok := node["_weight_"]; ok {
+		if err := json.Unmarshal(raw, &path.Cost); err != nil {
+			log.Fatalf("Unexpected weight in shortest path: %+v", err)
+		}
+	}
+
+	for node != nil {
+		var uid string
+		if err := json.Unmarshal(node["uid"], &uid); err != nil {
+			log.Fatalf("Unexpected uid in shortest path: %+v", err)
+		}
+		path.Uids = append(path.Uids, uid)
+
+		raw, ok := node[pred]
+		if !ok {
+			break
+		}
+		var next map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &next); err != nil {
+			var list []map[string]json.RawMessage
+			if err := json.Unmarshal(raw, &list); err != nil || len(list) == 0 {
+				log.Fatalf("Unexpected structure of shortest path: %s", raw)
+			}
+			next = list[0]
+		}
+		node = next
+	}
+	return path
+}
+
+func (s Store) PurgeEverything() {
+	s.w.PurgeEverything()
+}
+
+func (s Store) Close() {
+	s.w.Close()
+}
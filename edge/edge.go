@@ -1,6 +1,7 @@
 package edge
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"math"
@@ -9,25 +10,27 @@ import (
 	"time"
 
 	"github.com/breunigs/photoepics/cheapruler"
-	"github.com/breunigs/photoepics/dgraph"
 	"github.com/breunigs/photoepics/mapillary"
+	"github.com/breunigs/photoepics/store"
 	"github.com/paulmach/orb"
 	pb "gopkg.in/cheggaaa/pb.v1"
 )
 
 const month = 30 * 24 * time.Hour
 
-type edge struct {
-	from, to string
-	weight   float64
+// photos near two consecutive points along the track
+type stepPhotos struct {
+	step     int
+	from, to []mapillary.Photo
 }
 
-func (e edge) DgraphInsert() string {
-	return fmt.Sprintf("<%s> <transitionable> <%s> (weight=%f) .\n", e.from, e.to, e.weight)
-}
-
-func CalcWeightsAlong(db dgraph.Wrapper, lineStr orb.LineString, stepSize float64) <-chan dgraph.DgraphInsertable {
-	weightChan := make(chan dgraph.DgraphInsertable, 50)
+// CalcWeightsAlong emits the edges between photos near the line string. Once
+// ctx is done it stops and closes the channel, without marking the step it
+// was working on as done.
+func CalcWeightsAlong(ctx context.Context, db store.Store, session string, lineStr orb.LineString, stepSize float64, cp *store.Checkpoint) <-chan store.Edge {
+	// unbuffered, so that once a step is marked as done all of its edges
+	// have been received
+	weightChan := make(chan store.Edge)
 	var wg sync.WaitGroup
 	var seen sync.Map
 	go func() {
@@ -38,12 +41,21 @@ func CalcWeightsAlong(db dgraph.Wrapper, lineStr orb.LineString, stepSize float6
 
 		equidist := cheapruler.EveryN(lineStr, stepSize)
 
+		skip := func(step int) bool {
+			return cp.Done(edgeStep(step))
+		}
+
 		log.Println("Calculating weights for close images…")
 		bar := pb.StartNew(len(equidist) - 1)
-		picPairChan := findNearbyImages(db, equidist, stepSize*2)
+		picPairChan := findNearbyImages(ctx, db, session, equidist, stepSize*2, skip)
 
 		for picPair := range picPairChan {
-			calcWeights(weightChan, &seen, picPair[0], picPair[1])
+			if !skip(picPair.step) {
+				if !calcWeights(ctx, weightChan, &seen, picPair.from, picPair.to) {
+					break
+				}
+				cp.MarkDone(edgeStep(picPair.step))
+			}
 			bar.Increment()
 		}
 
@@ -53,8 +65,8 @@ func CalcWeightsAlong(db dgraph.Wrapper, lineStr orb.LineString, stepSize float6
 	return weightChan
 }
 
-func Count(db dgraph.Wrapper) int64 {
-	return db.Count("transitionable")
+func edgeStep(step int) string {
+	return fmt.Sprintf("edges/%d", step)
 }
 
 func dupeKey(p1, p2 mapillary.Photo) string {
@@ -65,7 +77,17 @@ func dupeKey(p1, p2 mapillary.Photo) string {
 	}
 }
 
-func calcWeights(weightChan chan<- dgraph.DgraphInsertable, seen *sync.Map, ps1, ps2 []mapillary.Photo) {
+// calcWeights returns false if ctx is done before all edges were emitted
+func calcWeights(ctx context.Context, weightChan chan<- store.Edge, seen *sync.Map, ps1, ps2 []mapillary.Photo) bool {
+	emit := func(e store.Edge) bool {
+		select {
+		case weightChan <- e:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
 	for _, p1 := range ps1 {
 		for _, p2 := range ps2 {
 			if p1.Key == p2.Key {
@@ -134,31 +156,47 @@ func calcWeights(weightChan chan<- dgraph.DgraphInsertable, seen *sync.Map, ps1,
 				bearing2 += 360
 			}
 
+			ok := true
 			if p1.AngleWithin(bearing1, 45) {
-				weightChan <- edge{from: p1.Uid, to: p2.Uid, weight: weight}
+				ok = emit(store.Edge{From: p1.Uid, To: p2.Uid, Weight: weight})
 			} else if p1.AngleWithin(bearing1, 90) {
-				weightChan <- edge{from: p1.Uid, to: p2.Uid, weight: weight + 5}
+				ok = emit(store.Edge{From: p1.Uid, To: p2.Uid, Weight: weight + 5})
 			}
 
 			if p2.AngleWithin(bearing2, 45) {
-				weightChan <- edge{from: p2.Uid, to: p1.Uid, weight: weight}
+				ok = ok && emit(store.Edge{From: p2.Uid, To: p1.Uid, Weight: weight})
 			} else if p2.AngleWithin(bearing2, 90) {
-				weightChan <- edge{from: p2.Uid, to: p1.Uid, weight: weight + 5}
+				ok = ok && emit(store.Edge{From: p2.Uid, To: p1.Uid, Weight: weight + 5})
+			}
+			if !ok {
+				return false
 			}
 		}
 	}
+	// a query for this step might have been cut short
+	return ctx.Err() == nil
 }
 
-func findNearbyImages(db dgraph.Wrapper, pts []orb.Point, radius float64) <-chan [2][]mapillary.Photo {
+// findNearbyImages emits the photos around each pair of consecutive points in
+// order. Points only needed for skipped steps are not queried. Once ctx is
+// done, no further points are queried and the channel is closed.
+func findNearbyImages(ctx context.Context, db store.Store, session string, pts []orb.Point, radius float64, skip func(step int) bool) <-chan stepPhotos {
 	cache := make([][]mapillary.Photo, len(pts))
 	var mu sync.Mutex
 
 	jobs := make(chan int, len(pts))
 	done := make(chan int, len(pts))
-	for w := 0; w < runtime.NumCPU()-1; w++ {
+	workers := runtime.NumCPU() - 1
+	if workers < 1 {
+		workers = 1
+	}
+	for w := 0; w < workers; w++ {
 		go func(jobs <-chan int, done chan<- int) {
 			for j := range jobs {
-				nearby := mapillary.PhotosNearQuery(db, pts[j], radius)
+				if ctx.Err() != nil {
+					return
+				}
+				nearby := db.PhotosNear(session, pts[j], radius)
 				mu.Lock()
 				cache[j] = nearby
 				mu.Unlock()
@@ -168,16 +206,29 @@ func findNearbyImages(db dgraph.Wrapper, pts []orb.Point, radius float64) <-chan
 	}
 
 	for i := 0; i < len(pts); i++ {
-		jobs <- i
+		// point i is used by the steps i-1 and i
+		needed := (i < len(pts)-1 && !skip(i)) || (i > 0 && !skip(i-1))
+		if needed {
+			jobs <- i
+		} else {
+			done <- i
+		}
 	}
 	close(jobs)
 
-	groupChan := make(chan [2][]mapillary.Photo, 1)
+	groupChan := make(chan stepPhotos, 1)
 	go func() {
+		defer close(groupChan)
 		startFrom := 0
 		status := make([]bool, len(pts))
 		for c := 0; c < len(pts); c++ {
-			status[<-done] = true
+			select {
+			case j := <-done:
+				status[j] = true
+			case <-ctx.Done():
+				return
+			}
+
 			// everytime a new query is done, try to emit the next pair
 			for i := startFrom; i < len(pts)-1; i++ {
 				if !status[i] || !status[i+1] {
@@ -185,14 +236,17 @@ func findNearbyImages(db dgraph.Wrapper, pts []orb.Point, radius float64) <-chan
 				}
 
 				mu.Lock()
-				groupChan <- [2][]mapillary.Photo{cache[i], cache[i+1]}
+				pair := stepPhotos{step: i, from: cache[i], to: cache[i+1]}
 				cache[i] = nil
 				mu.Unlock()
+				select {
+				case groupChan <- pair:
+				case <-ctx.Done():
+					return
+				}
 				startFrom = i + 1
 			}
 		}
-		close(done)
-		close(groupChan)
 	}()
 
 	return groupChan
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/paulmach/orb"
+)
+
+// Just enough of the FIT protocol to read the positions of an activity. See
+// the FIT SDK's "Flexible & Interoperable Data Transfer Protocol" for the
+// format.
+
+const (
+	fitRecordMesg = 20
+
+	fitFieldPositionLat  = 0
+	fitFieldPositionLong = 1
+)
+
+type fitFieldDef struct {
+	num  byte
+	size int
+}
+
+type fitDefinition struct {
+	global    uint16
+	order     binary.ByteOrder
+	fields    []fitFieldDef
+	devFields int // total size of the developer fields, which are skipped
+}
+
+// fitDecoder reads the data records of a FIT file
+type fitDecoder struct {
+	data        []byte
+	pos         int
+	definitions map[byte]*fitDefinition
+}
+
+// parseFIT reads the record messages of FIT files, e.g. from Garmin devices.
+// Records without a position are skipped. Several FIT files may be chained,
+// they become one track.
+func parseFIT(data []byte) ([]track, error) {
+	t := track{name: "FIT activity"}
+	for len(data) > 0 {
+		d, rest, err := newFitDecoder(data)
+		if err != nil {
+			return nil, err
+		}
+		if err := d.readRecords(&t); err != nil {
+			return nil, err
+		}
+		data = rest
+	}
+	return appendTrack(nil, t), nil
+}
+
+// newFitDecoder checks the file header and returns a decoder for its data
+// records as well as any data after the file
+func newFitDecoder(data []byte) (*fitDecoder, []byte, error) {
+	if len(data) < 12 {
+		return nil, nil, errors.New("FIT file is too short")
+	}
+	headerSize := int(data[0])
+	if headerSize < 12 || len(data) < headerSize || string(data[8:12]) != ".FIT" {
+		return nil, nil, errors.New("not a FIT file")
+	}
+	dataSize := int(binary.LittleEndian.Uint32(data[4:8]))
+	end := headerSize + dataSize
+	if len(data) < end {
+		return nil, nil, errors.New("FIT file is truncated")
+	}
+
+	rest := data[end:]
+	// skip the file's CRC
+	if len(rest) >= 2 {
+		rest = rest[2:]
+	}
+	d := &fitDecoder{
+		data:        data[headerSize:end],
+		definitions: make(map[byte]*fitDefinition),
+	}
+	return d, rest, nil
+}
+
+func (d *fitDecoder) readRecords(t *track) error {
+	for d.pos < len(d.data) {
+		header := d.data[d.pos]
+		d.pos++
+
+		switch {
+		case header&0x80 != 0:
+			// compressed timestamp header, always a data message. The time
+			// offset in the lower bits is not needed.
+			local := (header >> 5) & 0x03
+			if err := d.readData(local, t); err != nil {
+				return err
+			}
+		case header&0x40 != 0:
+			if err := d.readDefinition(header&0x0f, header&0x20 != 0); err != nil {
+				return err
+			}
+		default:
+			if err := d.readData(header&0x0f, t); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (d *fitDecoder) take(n int) ([]byte, error) {
+	if d.pos+n > len(d.data) {
+		return nil, errors.New("FIT file is truncated")
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+func (d *fitDecoder) readDefinition(local byte, hasDevFields bool) error {
+	head, err := d.take(5)
+	if err != nil {
+		return err
+	}
+	def := &fitDefinition{order: binary.LittleEndian}
+	if head[1] == 1 {
+		def.order = binary.BigEndian
+	}
+	def.global = def.order.Uint16(head[2:4])
+
+	fields, err := d.take(3 * int(head[4]))
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(fields); i += 3 {
+		def.fields = append(def.fields, fitFieldDef{num: fields[i], size: int(fields[i+1])})
+	}
+
+	if hasDevFields {
+		count, err := d.take(1)
+		if err != nil {
+			return err
+		}
+		devFields, err := d.take(3 * int(count[0]))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < len(devFields); i += 3 {
+			def.devFields += int(devFields[i+1])
+		}
+	}
+
+	d.definitions[local] = def
+	return nil
+}
+
+func (d *fitDecoder) readData(local byte, t *track) error {
+	def, ok := d.definitions[local]
+	if !ok {
+		return fmt.Errorf("FIT data message for undefined local message type %d", local)
+	}
+
+	lat, lon := int32(math.MaxInt32), int32(math.MaxInt32)
+	for _, f := range def.fields {
+		value, err := d.take(f.size)
+		if err != nil {
+			return err
+		}
+		switch {
+		case def.global != fitRecordMesg:
+			continue
+		case f.num == fitFieldPositionLat && f.size == 4:
+			lat = int32(def.order.Uint32(value))
+		case f.num == fitFieldPositionLong && f.size == 4:
+			lon = int32(def.order.Uint32(value))
+		}
+	}
+	if _, err := d.take(def.devFields); err != nil {
+		return err
+	}
+
+	if def.global != fitRecordMesg || lat == math.MaxInt32 || lon == math.MaxInt32 {
+		return nil
+	}
+	t.line = append(t.line, orb.Point{semicirclesToDegrees(lon), semicirclesToDegrees(lat)})
+	return nil
+}
+
+func semicirclesToDegrees(s int32) float64 {
+	return float64(s) * 180 / (1 << 31)
+}
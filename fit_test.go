@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+
+	"github.com/paulmach/orb"
+)
+
+// fitWriter builds FIT files for tests, always little endian
+type fitWriter struct {
+	data bytes.Buffer
+}
+
+// define adds a definition message. devSizes are the sizes of developer
+// fields, if any.
+func (w *fitWriter) define(local byte, global uint16, fields []fitFieldDef, devSizes ...byte) {
+	header := 0x40 | local
+	if len(devSizes) > 0 {
+		header |= 0x20
+	}
+	w.data.WriteByte(header)
+	w.data.Write([]byte{0, 0})
+	binary.Write(&w.data, binary.LittleEndian, global)
+	w.data.WriteByte(byte(len(fields)))
+	for _, f := range fields {
+		// the base type is not read
+		w.data.Write([]byte{f.num, byte(f.size), 0})
+	}
+	if len(devSizes) > 0 {
+		w.data.WriteByte(byte(len(devSizes)))
+		for i, size := range devSizes {
+			w.data.Write([]byte{byte(i), size, 0})
+		}
+	}
+}
+
+// write adds a data message with the given header and field values
+func (w *fitWriter) write(header byte, values ...interface{}) {
+	w.data.WriteByte(header)
+	for _, v := range values {
+		binary.Write(&w.data, binary.LittleEndian, v)
+	}
+}
+
+// file returns the data with a FIT file header and CRC, which are not checked
+func (w *fitWriter) file() []byte {
+	var f bytes.Buffer
+	f.Write([]byte{14, 0x20, 0, 0})
+	binary.Write(&f, binary.LittleEndian, uint32(w.data.Len()))
+	f.WriteString(".FIT")
+	f.Write([]byte{0, 0})
+	f.Write(w.data.Bytes())
+	f.Write([]byte{0, 0})
+	return f.Bytes()
+}
+
+func semicircles(deg float64) int32 {
+	return int32(deg * (1 << 31) / 180)
+}
+
+// the timestamp field, which is common to all messages
+const fitFieldTimestamp = 253
+
+// recordFields are timestamp, latitude and longitude
+var recordFields = []fitFieldDef{{fitFieldTimestamp, 4}, {fitFieldPositionLat, 4}, {fitFieldPositionLong, 4}}
+
+func TestFITNeedsTwoPoints(t *testing.T) {
+	var w fitWriter
+	w.define(0, fitRecordMesg, recordFields)
+	w.write(0, uint32(1000), semicircles(52.5165), semicircles(13.3777))
+
+	tracks, err := parseFIT(w.file())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tracks) != 0 {
+		t.Errorf("Got %d tracks from a single record, expected none", len(tracks))
+	}
+}
+
+func TestParseFIT(t *testing.T) {
+	ptA := orb.Point{13.3777, 52.5165}
+	ptB := orb.Point{13.3839, 52.5166}
+	ptC := orb.Point{13.3902, 52.5167}
+	record := func(w *fitWriter, header byte, p orb.Point) {
+		w.write(header, uint32(1000), semicircles(p[1]), semicircles(p[0]))
+	}
+
+	var plain fitWriter
+	// a file_id message, which is not a record
+	plain.define(0, 0, []fitFieldDef{{0, 1}, {fitFieldTimestamp, 4}})
+	plain.write(0, byte(4), uint32(1000))
+	plain.define(1, fitRecordMesg, recordFields)
+	record(&plain, 1, ptA)
+	// no GPS fix yet
+	plain.write(1, uint32(1001), int32(math.MaxInt32), int32(math.MaxInt32))
+	record(&plain, 1, ptB)
+
+	// compressed timestamp headers carry the local type in bits 5 and 6
+	var compressed fitWriter
+	compressed.define(2, fitRecordMesg, []fitFieldDef{{fitFieldPositionLat, 4}, {fitFieldPositionLong, 4}})
+	compressed.write(0x80|2<<5|1, semicircles(ptA[1]), semicircles(ptA[0]))
+	compressed.write(0x80|2<<5|31, semicircles(ptB[1]), semicircles(ptB[0]))
+
+	var dev fitWriter
+	dev.define(0, fitRecordMesg, recordFields, 2, 1)
+	record(&dev, 0, ptA)
+	dev.data.Write([]byte{0xff, 0xff, 0xff})
+	record(&dev, 0, ptB)
+	dev.data.Write([]byte{0xff, 0xff, 0xff})
+
+	var second fitWriter
+	second.define(0, fitRecordMesg, recordFields)
+	record(&second, 0, ptC)
+
+	tests := []struct {
+		name string
+		data []byte
+		want orb.LineString
+	}{
+		{"records", plain.file(), orb.LineString{ptA, ptB}},
+		{"compressed timestamps", compressed.file(), orb.LineString{ptA, ptB}},
+		{"developer fields", dev.file(), orb.LineString{ptA, ptB}},
+		{"chained", append(plain.file(), second.file()...), orb.LineString{ptA, ptB, ptC}},
+	}
+	for _, tt := range tests {
+		tracks, err := parseFIT(tt.data)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if len(tracks) != 1 {
+			t.Errorf("%s: got %d tracks, expected 1", tt.name, len(tracks))
+			continue
+		}
+		if got := tracks[0].line; !equalLines(got, tt.want, 1e-6) {
+			t.Errorf("%s: got %v, expected %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseFITErrors(t *testing.T) {
+	var w fitWriter
+	w.define(0, fitRecordMesg, recordFields)
+	w.write(0, uint32(1000), semicircles(52.5165), semicircles(13.3777))
+	w.write(0, uint32(1001), semicircles(52.5166), semicircles(13.3839))
+	file := w.file()
+
+	var undefined fitWriter
+	undefined.write(3, uint32(1000))
+
+	// the header claims more data than there is
+	short := append([]byte{}, file[:len(file)-7]...)
+	// the header fits the data, but the last record is cut off
+	cut := append([]byte{}, short...)
+	binary.LittleEndian.PutUint32(cut[4:8], uint32(len(cut)-14))
+
+	var defCut fitWriter
+	defCut.define(0, fitRecordMesg, recordFields)
+	defCut.data.Truncate(defCut.data.Len() - 2)
+
+	tests := map[string][]byte{
+		"too short":         file[:10],
+		"not FIT":           append([]byte{14, 0x20, 0, 0, 0, 0, 0, 0, '.', 'G', 'P', 'X'}, file[12:]...),
+		"truncated file":    short,
+		"truncated record":  cut,
+		"truncated message": defCut.file(),
+		"undefined type":    undefined.file(),
+		"truncated chain":   append(file, file[:20]...),
+	}
+	for name, data := range tests {
+		if _, err := parseFIT(data); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+// equalLines compares the points up to the given precision in degrees
+func equalLines(a, b orb.LineString, precision float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if math.Abs(a[i][0]-b[i][0]) > precision || math.Abs(a[i][1]-b[i][1]) > precision {
+			return false
+		}
+	}
+	return true
+}
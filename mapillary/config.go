@@ -1,10 +1,23 @@
 package mapillary
 
+import (
+	"context"
+	"strings"
+
+	"github.com/breunigs/photoepics/browser"
+)
+
 const mapillaryBaseUrl = "https://a.mapillary.com/v3/"
 
+const defaultTilesBaseUrl = "https://tiles.mapillary.com/maps/vtp/mly1_public/2/"
+const defaultGraphBaseUrl = "https://graph.mapillary.com/"
+
 // zoom level at which the bbox are aligned (using OSM tile boundaries)
 const gridZoomLevel = 15
 
+// zoom level of the v4 coverage tiles. Only this one contains the image layer.
+const coverageZoomLevel = 14
+
 // when retrieving data within a bounding box aligned to tiles, add this much border
 // or overlap. 1 = 9 times the area of the bbox, so 0.05 = 5% border around tile
 const tileBuffer = 0.05
@@ -12,12 +25,81 @@ const tileBuffer = 0.05
 // how many image details to fetch from Mapillary's private API per request
 const imageDetailsChunkSize = 100
 
+// how many tiles are read at the same time, and how many image detail
+// requests may be running at once across all of them. The browser limits
+// requests per host further.
+const tileWorkers = 4
+const maxDetailRequests = 8
+
 // how many meters of distance between two photos are allowed, before the
 // Mapillary Viewer will not transition anymore.
 const maxTransitionDistance = 25
 
+// SearchRadius is how many meters photos may be away from the track to be
+// used. All tiles within this distance of the track are read.
+const SearchRadius = 25
+
 type Config struct {
 	FilterNewer string
 	FilterUsers string
 	APIKey      string
+
+	// API is the Mapillary API version to use, either "v4" (default) or "v3"
+	API string
+	// where to find the v3 API. Empty means Mapillary's servers.
+	BaseURL string
+	// where to find the v4 coverage tiles and Graph API. Empty means
+	// Mapillary's public servers.
+	TilesBaseURL string
+	GraphBaseURL string
+
+	// Fetcher reads the API responses. Nil means the cached and rate limited
+	// browser.Get.
+	Fetcher Fetcher
+}
+
+// Fetcher reads URLs for the mapillary package. Errors about the response's
+// status should wrap browser.ErrNotFound, ErrUnauthorized and
+// ErrRateLimited like browser.Get does, so that they are handled the same.
+type Fetcher interface {
+	Get(ctx context.Context, url string) (string, error)
+}
+
+func (c Config) fetcher() Fetcher {
+	if c.Fetcher == nil {
+		return browser.Browser{}
+	}
+	return c.Fetcher
+}
+
+func (c Config) baseUrl() string {
+	if c.BaseURL == "" {
+		return mapillaryBaseUrl
+	}
+	return withSlash(c.BaseURL)
+}
+
+func (c Config) tilesBaseUrl() string {
+	if c.TilesBaseURL == "" {
+		return defaultTilesBaseUrl
+	}
+	return withSlash(c.TilesBaseURL)
+}
+
+func (c Config) graphBaseUrl() string {
+	if c.GraphBaseURL == "" {
+		return defaultGraphBaseUrl
+	}
+	return withSlash(c.GraphBaseURL)
+}
+
+func (c Config) useV3() bool {
+	return c.API == "v3"
+}
+
+func withSlash(url string) string {
+	if strings.HasSuffix(url, "/") {
+		return url
+	}
+	return url + "/"
 }
@@ -0,0 +1,151 @@
+// Package fake serves the parts of Mapillary's APIs that photoepics uses from
+// fixture files, so that loading can be run offline and reproducibly.
+package fake
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	"github.com/breunigs/photoepics/mapillary"
+	"github.com/mitchellh/mapstructure"
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+)
+
+// SequencesFile contains the sequences in the same format as v3's
+// /sequences endpoint: a FeatureCollection of LineStrings with the
+// properties key, username and coordinateProperties.
+const SequencesFile = "sequences.geojson"
+
+// ImagesFile contains the corrected details of each image by key.
+const ImagesFile = "images.json"
+
+// Image holds the details Mapillary computed for an image, as stored in
+// ImagesFile
+type Image struct {
+	CapturedAt  int64   `json:"captured_at"`
+	MergeCC     int64   `json:"merge_cc"`
+	CameraAngle float64 `json:"cca"`
+	Location    struct {
+		Lon float64 `json:"lon"`
+		Lat float64 `json:"lat"`
+	} `json:"cl"`
+}
+
+// image is an image's position within its sequence
+type image struct {
+	Image
+	key      string
+	sequence *geojson.Feature
+	orgLoc   orb.Point
+	orgAngle float64
+	username string
+}
+
+// Fixtures is the data the fake server responds with
+type Fixtures struct {
+	sequences *geojson.FeatureCollection
+	images    map[string]*image
+	// image keys in the order they appear in the sequences
+	order []string
+	// when the first image of each sequence was captured
+	started map[string]time.Time
+}
+
+type coordinateProperties struct {
+	Image_keys []string
+	Cas        []float64
+}
+
+// Load reads SequencesFile and ImagesFile from the given directory
+func Load(dir string) (*Fixtures, error) {
+	raw, err := ioutil.ReadFile(filepath.Join(dir, SequencesFile))
+	if err != nil {
+		return nil, err
+	}
+	fc, err := geojson.UnmarshalFeatureCollection(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", SequencesFile, err)
+	}
+
+	raw, err = ioutil.ReadFile(filepath.Join(dir, ImagesFile))
+	if err != nil {
+		return nil, err
+	}
+	var details map[string]Image
+	if err := json.Unmarshal(raw, &details); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", ImagesFile, err)
+	}
+
+	f := &Fixtures{
+		sequences: fc,
+		images:    make(map[string]*image),
+		started:   make(map[string]time.Time),
+	}
+	for _, feat := range fc.Features {
+		ls, ok := feat.Geometry.(orb.LineString)
+		if !ok {
+			return nil, fmt.Errorf("sequence %v is a %s, not a LineString", feat.Properties["key"], feat.Geometry.GeoJSONType())
+		}
+
+		var cp coordinateProperties
+		if err := mapstructure.Decode(feat.Properties["coordinateProperties"], &cp); err != nil {
+			return nil, fmt.Errorf("invalid coordinateProperties in sequence %v: %v", feat.Properties["key"], err)
+		}
+		if len(cp.Image_keys) != len(ls) || len(cp.Cas) != len(ls) {
+			return nil, fmt.Errorf("sequence %v has %d points, but %d image keys and %d camera angles", feat.Properties["key"], len(ls), len(cp.Image_keys), len(cp.Cas))
+		}
+
+		for i, key := range cp.Image_keys {
+			d, ok := details[key]
+			if !ok {
+				return nil, fmt.Errorf("image %s of sequence %v is missing in %s", key, feat.Properties["key"], ImagesFile)
+			}
+			f.images[key] = &image{
+				Image:    d,
+				key:      key,
+				sequence: feat,
+				orgLoc:   ls[i],
+				orgAngle: cp.Cas[i],
+				username: feat.Properties.MustString("username", ""),
+			}
+			f.order = append(f.order, key)
+			if i == 0 {
+				f.started[f.images[key].sequenceKey()] = f.images[key].captured()
+			}
+		}
+	}
+	return f, nil
+}
+
+func (img *image) sequenceKey() string {
+	return img.sequence.Properties.MustString("key", "")
+}
+
+func (img *image) captured() time.Time {
+	return time.Unix(img.CapturedAt/1000, 0)
+}
+
+// Photos returns the photos that loading along all of the fixtures should
+// find, in the order of their sequences. Their DistFromPath is not set.
+func (f *Fixtures) Photos() []mapillary.Photo {
+	photos := make([]mapillary.Photo, 0, len(f.order))
+	for _, key := range f.order {
+		img := f.images[key]
+		p := mapillary.Photo{
+			Key:            key,
+			Sequence:       img.sequenceKey(),
+			CameraAngle:    img.CameraAngle,
+			OrgCameraAngle: img.orgAngle,
+			MergeCC:        img.MergeCC,
+			Captured:       img.captured(),
+		}
+		p.SetOrgLocation(img.orgLoc)
+		p.SetLocation(orb.Point{img.Location.Lon, img.Location.Lat})
+		photos = append(photos, p)
+	}
+	return photos
+}
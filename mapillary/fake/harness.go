@@ -0,0 +1,144 @@
+package fake
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"sync"
+
+	"github.com/breunigs/photoepics/browser"
+	"github.com/breunigs/photoepics/cheapruler"
+	"github.com/breunigs/photoepics/mapillary"
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+)
+
+// TrackFile is a FeatureCollection whose first feature is a LineString along
+// the fixtures. Only the Harness needs it.
+const TrackFile = "track.geojson"
+
+// Harness serves fixtures for tests of the loading pipeline
+type Harness struct {
+	Fixtures *Fixtures
+	// the line in TrackFile
+	Track  orb.LineString
+	Server *httptest.Server
+	// reads from Server and records the requested URLs
+	Fetcher *RecordingFetcher
+}
+
+// NewHarness serves the fixtures in dir. Like a load, it initializes the
+// cheapruler for the track's latitude.
+func NewHarness(dir string) (*Harness, error) {
+	f, err := Load(dir)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := ioutil.ReadFile(filepath.Join(dir, TrackFile))
+	if err != nil {
+		return nil, err
+	}
+	fc, err := geojson.UnmarshalFeatureCollection(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", TrackFile, err)
+	}
+	if len(fc.Features) == 0 {
+		return nil, fmt.Errorf("%s has no features", TrackFile)
+	}
+	track, ok := fc.Features[0].Geometry.(orb.LineString)
+	if !ok || len(track) < 2 {
+		return nil, fmt.Errorf("%s does not start with a LineString of at least two points", TrackFile)
+	}
+
+	cheapruler.Init(track[0][1])
+	return &Harness{
+		Fixtures: f,
+		Track:    track,
+		Server:   NewServer(f),
+		Fetcher:  &RecordingFetcher{},
+	}, nil
+}
+
+// Config returns a config for the given API that reads from the server with
+// the harness' Fetcher
+func (h *Harness) Config(api string) mapillary.Config {
+	conf := Config(h.Server.URL, api)
+	conf.Fetcher = h.Fetcher
+	return conf
+}
+
+func (h *Harness) Close() {
+	h.Server.Close()
+}
+
+// FindPhotos loads along the line and returns the photos by key. Finding a
+// photo twice is an error.
+func FindPhotos(conf mapillary.Config, line orb.LineString) (map[string]mapillary.Photo, error) {
+	photos, err := mapillary.FindSequences(context.Background(), conf, line, NoProgress{})
+	if err != nil {
+		return nil, err
+	}
+	found := make(map[string]mapillary.Photo)
+	for p := range photos {
+		if _, dup := found[p.Key]; dup {
+			err = fmt.Errorf("photo %s was found twice", p.Key)
+		}
+		found[p.Key] = *p
+	}
+	return found, err
+}
+
+// NoProgress loads everything and forgets what was done
+type NoProgress struct{}
+
+func (NoProgress) Done(step string) bool { return false }
+func (NoProgress) MarkDone(step string)  {}
+
+// RecordingFetcher reads directly via HTTP, without the browser's cache and
+// rate limits, and remembers the requested URLs
+type RecordingFetcher struct {
+	mu   sync.Mutex
+	urls []*url.URL
+}
+
+func (r *RecordingFetcher) Get(ctx context.Context, uri string) (string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", err
+	}
+	r.mu.Lock()
+	r.urls = append(r.urls, u)
+	r.mu.Unlock()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", uri, nil)
+	if err != nil {
+		return "", err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", &browser.StatusError{URL: uri, StatusCode: res.StatusCode, Status: res.Status}
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	return string(body), err
+}
+
+// URLs returns the URLs requested since the last Reset
+func (r *RecordingFetcher) URLs() []*url.URL {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*url.URL{}, r.urls...)
+}
+
+func (r *RecordingFetcher) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.urls = nil
+}
@@ -0,0 +1,328 @@
+package fake
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/breunigs/photoepics/browser"
+	"github.com/breunigs/photoepics/mapillary"
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/encoding/mvt"
+	"github.com/paulmach/orb/geojson"
+	"github.com/paulmach/orb/maptile"
+)
+
+// paths below the server's root at which the APIs are served
+const (
+	v3Path    = "/v3/"
+	tilesPath = "/v4/tiles/"
+	graphPath = "/v4/graph/"
+)
+
+// only tiles at this zoom level contain images, like on Mapillary
+const imageZoomLevel = 14
+
+// Handler serves v3's /sequences and /model.json as well as v4's coverage
+// tiles and Graph API /images from the fixtures
+func (f *Fixtures) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(v3Path+"sequences", requireParam("client_id", f.serveSequences))
+	mux.HandleFunc(v3Path+"model.json", requireParam("client_id", f.serveModel))
+	mux.HandleFunc(tilesPath, requireParam("access_token", f.serveTile))
+	mux.HandleFunc(graphPath+"images", requireParam("access_token", f.serveImages))
+	return withETag(mux)
+}
+
+// withETag adds an ETag to all successful responses and answers conditional
+// requests, so that revalidating cached responses can be tried
+func withETag(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := httptest.NewRecorder()
+		next.ServeHTTP(rec, r)
+
+		for k, v := range rec.Header() {
+			w.Header()[k] = v
+		}
+		if rec.Code == http.StatusOK {
+			sum := md5.Sum(rec.Body.Bytes())
+			etag := `"` + hex.EncodeToString(sum[:]) + `"`
+			w.Header().Set("ETag", etag)
+			if r.Header.Get("If-None-Match") == etag {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+		w.WriteHeader(rec.Code)
+		w.Write(rec.Body.Bytes())
+	})
+}
+
+// NewServer starts a fake Mapillary on a random local port. Callers should
+// Close it when done.
+func NewServer(f *Fixtures) *httptest.Server {
+	return httptest.NewServer(f.Handler())
+}
+
+// Config returns a mapillary.Config that uses the fake server reachable at
+// baseURL with the given API version
+func Config(baseURL string, api string) mapillary.Config {
+	baseURL = strings.TrimSuffix(baseURL, "/")
+	return mapillary.Config{
+		APIKey:       "fake",
+		API:          api,
+		BaseURL:      baseURL + v3Path,
+		TilesBaseURL: baseURL + tilesPath,
+		GraphBaseURL: baseURL + graphPath,
+	}
+}
+
+func requireParam(param string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get(param) == "" {
+			http.Error(w, `{"message":"missing `+param+`"}`, http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Failed to write fake response: %v", err)
+	}
+}
+
+// serveSequences returns all sequences that touch the bbox, optionally
+// filtered by usernames and start_time
+func (f *Fixtures) serveSequences(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	bbox, err := parseBbox(q.Get("bbox"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var users []string
+	if u := q.Get("usernames"); u != "" {
+		users = strings.Split(u, ",")
+	}
+	var newer time.Time
+	if start := q.Get("start_time"); start != "" {
+		newer, err = time.Parse("2006-01-02", start)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	fc := geojson.NewFeatureCollection()
+	for _, feat := range f.sequences.Features {
+		if !feat.Geometry.Bound().Intersects(bbox) {
+			continue
+		}
+		if len(users) > 0 && !contains(users, feat.Properties.MustString("username", "")) {
+			continue
+		}
+		if f.started[feat.Properties.MustString("key", "")].Before(newer) {
+			continue
+		}
+		fc.Append(feat)
+	}
+	writeJSON(w, fc)
+}
+
+type atom struct {
+	Type  string      `json:"$type"`
+	Value interface{} `json:"value"`
+}
+
+// serveModel answers imageByKey requests, ignoring which fields are asked
+// for
+func (f *Fixtures) serveModel(w http.ResponseWriter, r *http.Request) {
+	var paths [][]json.RawMessage
+	if err := json.Unmarshal([]byte(r.URL.Query().Get("paths")), &paths); err != nil || len(paths) == 0 || len(paths[0]) < 2 {
+		http.Error(w, "invalid paths", http.StatusBadRequest)
+		return
+	}
+	var keys []string
+	if err := json.Unmarshal(paths[0][1], &keys); err != nil {
+		http.Error(w, "invalid image keys in paths", http.StatusBadRequest)
+		return
+	}
+
+	byKey := make(map[string]map[string]atom)
+	for _, key := range keys {
+		img, ok := f.images[key]
+		if !ok {
+			continue
+		}
+		byKey[key] = map[string]atom{
+			"captured_at": {"atom", img.CapturedAt},
+			"merge_cc":    {"atom", img.MergeCC},
+			"cca":         {"atom", img.CameraAngle},
+			"cl":          {"atom", img.Location},
+		}
+	}
+
+	writeJSON(w, map[string]interface{}{
+		"jsonGraph": map[string]interface{}{"imageByKey": byKey},
+	})
+}
+
+// serveTile returns a vector tile with a sequence and an image layer. Tiles
+// without images are empty.
+func (f *Fixtures) serveTile(w http.ResponseWriter, r *http.Request) {
+	tile, err := parseTile(strings.TrimPrefix(r.URL.Path, tilesPath))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	if tile.Z != imageZoomLevel {
+		return
+	}
+
+	bound := tile.Bound()
+	sequences := geojson.NewFeatureCollection()
+	for _, seq := range f.sequences.Features {
+		if !seq.Geometry.Bound().Intersects(bound) {
+			continue
+		}
+		key := seq.Properties.MustString("key", "")
+		// projecting to the tile changes the geometry in place
+		feat := geojson.NewFeature(orb.Clone(seq.Geometry))
+		feat.Properties["id"] = key
+		feat.Properties["captured_at"] = f.started[key].Unix() * 1000
+		sequences.Append(feat)
+	}
+
+	fc := geojson.NewFeatureCollection()
+	for _, key := range f.order {
+		img := f.images[key]
+		if !bound.Contains(img.orgLoc) {
+			continue
+		}
+		feat := geojson.NewFeature(img.orgLoc)
+		feat.Properties["id"] = img.key
+		feat.Properties["sequence_id"] = img.sequenceKey()
+		feat.Properties["captured_at"] = img.CapturedAt
+		feat.Properties["compass_angle"] = img.orgAngle
+		fc.Append(feat)
+	}
+	if len(fc.Features) == 0 {
+		return
+	}
+
+	layers := mvt.Layers{mvt.NewLayer("sequence", sequences), mvt.NewLayer("image", fc)}
+	layers.ProjectToTile(tile)
+	layers.Clip(mvt.MapboxGLDefaultExtentBound)
+	data, err := mvt.Marshal(layers)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(data)
+}
+
+type graphPoint struct {
+	Type        string    `json:"type"`
+	Coordinates []float64 `json:"coordinates"`
+}
+
+// serveImages answers Graph API requests for several images, ignoring which
+// fields are asked for
+func (f *Fixtures) serveImages(w http.ResponseWriter, r *http.Request) {
+	var data []map[string]interface{}
+	for _, key := range strings.Split(r.URL.Query().Get("image_ids"), ",") {
+		img, ok := f.images[key]
+		if !ok {
+			continue
+		}
+		data = append(data, map[string]interface{}{
+			"id":                     img.key,
+			"sequence":               img.sequenceKey(),
+			"captured_at":            img.CapturedAt,
+			"compass_angle":          img.orgAngle,
+			"computed_compass_angle": img.CameraAngle,
+			"geometry":               graphPoint{"Point", []float64{img.orgLoc[0], img.orgLoc[1]}},
+			"computed_geometry":      graphPoint{"Point", []float64{img.Location.Lon, img.Location.Lat}},
+			"merge_cc":               img.MergeCC,
+			"creator":                map[string]string{"username": img.username},
+		})
+	}
+	writeJSON(w, map[string]interface{}{"data": data})
+}
+
+func parseBbox(s string) (orb.Bound, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return orb.Bound{}, fmt.Errorf("expected bbox=minLon,minLat,maxLon,maxLat but got %q", s)
+	}
+	var v [4]float64
+	for i, p := range parts {
+		var err error
+		if v[i], err = strconv.ParseFloat(p, 64); err != nil {
+			return orb.Bound{}, fmt.Errorf("invalid bbox %q: %v", s, err)
+		}
+	}
+	return orb.Bound{Min: orb.Point{v[0], v[1]}, Max: orb.Point{v[2], v[3]}}, nil
+}
+
+func parseTile(s string) (maptile.Tile, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) != 3 {
+		return maptile.Tile{}, fmt.Errorf("expected z/x/y but got %q", s)
+	}
+	var v [3]uint64
+	for i, p := range parts {
+		var err error
+		if v[i], err = strconv.ParseUint(p, 10, 32); err != nil {
+			return maptile.Tile{}, fmt.Errorf("invalid tile %q: %v", s, err)
+		}
+	}
+	return maptile.New(uint32(v[1]), uint32(v[2]), maptile.Zoom(v[0])), nil
+}
+
+func contains(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Fetcher answers requests from the fixtures directly, without a server,
+// cache or rate limits. Use it as mapillary.Config.Fetcher together with
+// Config and any base URL.
+func (f *Fixtures) Fetcher() mapillary.Fetcher {
+	return handlerFetcher{f.Handler()}
+}
+
+type handlerFetcher struct {
+	handler http.Handler
+}
+
+func (h handlerFetcher) Get(ctx context.Context, url string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return "", err
+	}
+	rec := httptest.NewRecorder()
+	h.handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		status := fmt.Sprintf("%d %s", rec.Code, http.StatusText(rec.Code))
+		return "", &browser.StatusError{URL: url, StatusCode: rec.Code, Status: status}
+	}
+	return rec.Body.String(), nil
+}
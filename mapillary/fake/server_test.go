@@ -0,0 +1,97 @@
+package fake_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/breunigs/photoepics/browser"
+	"github.com/breunigs/photoepics/mapillary"
+	"github.com/breunigs/photoepics/mapillary/fake"
+)
+
+func startFake(t *testing.T) *fake.Harness {
+	h, err := fake.NewHarness("fixtures")
+	if err != nil {
+		t.Fatalf("Failed to load fixtures: %v", err)
+	}
+	return h
+}
+
+// checkFindSequences loads along the track and expects to find exactly the
+// photos of the fixtures, which are all close to it
+func checkFindSequences(t *testing.T, h *fake.Harness, conf mapillary.Config) {
+	found, err := fake.FindPhotos(conf, h.Track)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, p := range found {
+		if p.DistFromPath > mapillary.SearchRadius {
+			t.Errorf("Photo %s is %.1fm from the track, expected at most %dm", key, p.DistFromPath, mapillary.SearchRadius)
+		}
+		p.DistFromPath = 0
+		found[key] = p
+	}
+
+	want := h.Fixtures.Photos()
+	if len(found) != len(want) {
+		t.Errorf("Found %d photos, expected %d", len(found), len(want))
+	}
+	for _, w := range want {
+		got, ok := found[w.Key]
+		if !ok {
+			t.Errorf("Photo %s was not found", w.Key)
+			continue
+		}
+		if !reflect.DeepEqual(got, w) {
+			t.Errorf("Photo %s differs from the fixtures:\n got: %+v\nwant: %+v", w.Key, got, w)
+		}
+	}
+}
+
+func TestFindSequences(t *testing.T) {
+	h := startFake(t)
+	defer h.Close()
+
+	for _, api := range []string{"v3", "v4"} {
+		t.Run(api, func(t *testing.T) {
+			checkFindSequences(t, h, h.Config(api))
+		})
+	}
+}
+
+func TestFetcher(t *testing.T) {
+	h := startFake(t)
+	defer h.Close()
+
+	for _, api := range []string{"v3", "v4"} {
+		t.Run(api, func(t *testing.T) {
+			conf := fake.Config("http://fake.invalid", api)
+			conf.Fetcher = h.Fixtures.Fetcher()
+			checkFindSequences(t, h, conf)
+		})
+	}
+}
+
+func TestFetcherErrors(t *testing.T) {
+	h := startFake(t)
+	defer h.Close()
+	fetcher := h.Fixtures.Fetcher()
+	ctx := context.Background()
+
+	tests := []struct {
+		url  string
+		want error
+	}{
+		{"http://fake.invalid/v3/unknown?client_id=fake", browser.ErrNotFound},
+		{"http://fake.invalid/v3/sequences?bbox=1,2,3,4", browser.ErrUnauthorized},
+		{"http://fake.invalid/v4/tiles/14/1/2", browser.ErrUnauthorized},
+	}
+	for _, tt := range tests {
+		_, err := fetcher.Get(ctx, tt.url)
+		if !errors.Is(err, tt.want) {
+			t.Errorf("Get(%s) returned %v, expected %v", tt.url, err, tt.want)
+		}
+	}
+}
@@ -1,15 +1,10 @@
 package mapillary
 
 import (
-	"encoding/json"
-	"fmt"
-	"log"
 	"math"
-	"strings"
 	"time"
 
 	"github.com/breunigs/photoepics/cheapruler"
-	"github.com/breunigs/photoepics/dgraph"
 	"github.com/paulmach/orb"
 )
 
@@ -18,21 +13,6 @@ type loc struct {
 	Coords []float64 `json:"coordinates,omitempty"`
 }
 
-type root struct {
-	Photos []Photo `json:"photos"`
-}
-
-const PhotoReadQueryBody = `
-  uid
-  key
-  loc
-  sequence
-  cameraAngle
-  mergeCC
-  captured
-  distFromPath
-`
-
 type Photo struct {
 	Uid            string    `json:"uid,omitempty"`
 	Key            string    `json:"key,omitempty"`
@@ -87,91 +67,19 @@ func (p *Photo) Dist(other Photo) float64 {
 	return cheapruler.Dist(p.Loc.Coords, other.Loc.Coords)
 }
 
-func (p *Photo) AngleWithin(bearing, plusminus float64) bool {
-	return p.CameraAngle-plusminus < bearing && bearing < p.CameraAngle+plusminus
-}
-
-func (p *Photo) IRIKey() string {
-	k := strings.Replace(p.Key, "-", "ü", -1)
-	return strings.Replace(k, "_", "Ö", -1)
-}
-
-func (p *Photo) DgraphInsert() string {
-	k := p.IRIKey()
-	return fmt.Sprintf(`
-    _:`+k+` <loc> "{'type':'Point','coordinates':[%f,%f]}"^^<geo:geojson> .
-    _:`+k+` <orgLoc> "{'type':'Point','coordinates':[%f,%f]}"^^<geo:geojson> .
-    _:`+k+` <key> "%s" .
-    _:`+k+` <sequence> "%s" .
-    _:`+k+` <cameraAngle> "%f" .
-    _:`+k+` <orgCameraAngle> "%f" .
-    _:`+k+` <mergeCC> "%d" .
-    _:`+k+` <captured> "%s" .
-    _:`+k+` <distFromPath> "%f" .
-  `,
-		p.Loc.Coords[0], p.Loc.Coords[1],
-		p.OrgLoc.Coords[0], p.OrgLoc.Coords[1],
-		p.Key, p.Sequence, p.CameraAngle, p.OrgCameraAngle, p.MergeCC, p.RFC3339(), p.DistFromPath)
-}
-
-func PhotoCount(db dgraph.Wrapper) int64 {
-	cnt := float64(db.Count("key"))
-	cnt = math.Max(cnt, float64(db.Count("loc")))
-	cnt = math.Max(cnt, float64(db.Count("distFromPath")))
-	return int64(cnt)
-}
-
-func PhotoByKey(db dgraph.Wrapper, key string) Photo {
-	query := `query PhotoByKey($key: string) {
-    photos(func: eq(key, $key)) { ` + PhotoReadQueryBody + ` }
-  }`
-	params := map[string]string{
-		"$key": key,
+// AngleDiff returns by how many degrees (0 to 180) the camera deviates from
+// the given bearing
+func (p *Photo) AngleDiff(bearing float64) float64 {
+	diff := math.Mod(p.CameraAngle-bearing, 360)
+	if diff < 0 {
+		diff += 360
 	}
-	resp := db.Query(query, params)
-
-	var r root
-	if err := json.Unmarshal(resp, &r); err != nil {
-		log.Fatal(err)
-	}
-
-	if len(r.Photos) != 1 {
-		log.Fatalf("Expected to find exactly one photo with key=%s, but found %d", key, len(r.Photos))
+	if diff > 180 {
+		diff = 360 - diff
 	}
-
-	return r.Photos[0]
+	return diff
 }
 
-func PhotosNearQuery(db dgraph.Wrapper, pt orb.Point, radius float64) []Photo {
-	query := fmt.Sprintf(`
-    query PhotosNear($loc: string, $radius: float) {
-      photos(func: near(loc, $loc, $radius) ) { ` + PhotoReadQueryBody + ` }
-    }`)
-	params := map[string]string{
-		"$loc":    fmt.Sprintf("[%f, %f]", pt[0], pt[1]),
-		"$radius": fmt.Sprintf("%f", radius),
-	}
-
-	resp := db.Query(query, params)
-
-	var r root
-	if err := json.Unmarshal(resp, &r); err != nil {
-		log.Fatal(err)
-	}
-
-	return r.Photos
-}
-
-func PhotoDgraphSchema() string {
-	return `
-    key: string @index(exact) .
-    loc: geo @index(geo) .
-    orgLoc: geo .
-    sequence: string .
-    cameraAngle: float .
-    orgCameraAngle: float .
-    mergeCC: int .
-    captured: dateTime .
-    distFromPath: float .
-  `
+func (p *Photo) AngleWithin(bearing, plusminus float64) bool {
+	return p.CameraAngle-plusminus < bearing && bearing < p.CameraAngle+plusminus
 }
@@ -1,7 +1,9 @@
 package mapillary
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"regexp"
@@ -47,39 +49,63 @@ type graphImageByKey struct {
 	} `json:"jsonGraph"`
 }
 
-func getApi(conf Config, fun string, query string) string {
-	url := mapillaryBaseUrl + fun
+// get reads the URL with the configured Fetcher and exits on errors. Missing
+// resources are treated as empty. It returns false if ctx is done, or if the
+// URL is not cached in offline mode, since the response is incomplete then.
+// Uncached URLs can be listed with browser.MissingURLs.
+func get(ctx context.Context, conf Config, url string) (string, bool) {
+	body, err := conf.fetcher().Get(ctx, url)
+	if ctx.Err() != nil {
+		return "", false
+	}
+	switch {
+	case err == nil:
+		return body, true
+	case errors.Is(err, browser.ErrNotFound):
+		return "", true
+	case errors.Is(err, browser.ErrNotCached):
+		return "", false
+	case errors.Is(err, browser.ErrUnauthorized):
+		log.Fatalf("Mapillary rejected the request, please check the --api-key: %v", err)
+	case errors.Is(err, browser.ErrRateLimited):
+		log.Fatalf("Mapillary is still rate limiting requests, please try again later: %v", err)
+	}
+	log.Fatalf("Failed to read from Mapillary: %+v", err)
+	return "", false
+}
+
+func getApi(ctx context.Context, conf Config, fun string, query string) (string, bool) {
+	url := conf.baseUrl() + fun
 	url += "?client_id=" + conf.APIKey
 	url += maybeFilterUsers(conf)
 	url += maybeFilterNewer(conf)
 	if query != "" {
 		url += "&" + query
 	}
-	body, err := browser.Get(url)
-	if err != nil {
-		log.Fatalf("Failed to read from Mapillary: %+v", err)
-	}
-	return body
+	return get(ctx, conf, url)
 }
 
-func getImageByKeys(conf Config, imageKey []string) map[string]imageByKey {
+// getImageByKeys reads the details of the given images. Images Mapillary
+// doesn't know are missing from the map, it is empty if the request was not
+// found at all. Like get, it returns false if the response is incomplete.
+func getImageByKeys(ctx context.Context, conf Config, imageKey []string) (map[string]imageByKey, bool) {
 	imgKeys := strings.Join(imageKey, `","`)
 
-	url := mapillaryBaseUrl + "model.json"
+	url := conf.baseUrl() + "model.json"
 	url += "?client_id=" + conf.APIKey
 	url += "&method=get"
 	url += fmt.Sprintf(`&paths=[["imageByKey",["%s"],["captured_at","merge_cc","cca","cl"]]]`, imgKeys)
-	body, err := browser.Get(url)
-	if err != nil {
-		log.Fatalf("Failed to read from Mapillary: %+v", err)
+	body, ok := get(ctx, conf, url)
+	if !ok || body == "" {
+		return nil, ok
 	}
 
 	res := graphImageByKey{}
-	err = json.Unmarshal([]byte(body), &res)
+	err := json.Unmarshal([]byte(body), &res)
 	if err != nil {
 		log.Fatalf("Unexpected output for imageByKey: %+v", err)
 	}
-	return res.JsonGraph.ImageByKey
+	return res.JsonGraph.ImageByKey, true
 }
 
 func maybeFilterUsers(conf Config) string {
@@ -1,16 +1,22 @@
 package mapillary
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/breunigs/photoepics/browser"
 	"github.com/breunigs/photoepics/cheapruler"
 	"github.com/mitchellh/mapstructure"
 	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geo"
 	"github.com/paulmach/orb/geojson"
 	"github.com/paulmach/orb/maptile"
+	"github.com/paulmach/orb/maptile/tilecover"
 	pb "gopkg.in/cheggaaa/pb.v1"
 )
 
@@ -19,73 +25,227 @@ type coordinateProperties struct {
 	Cas        []float64
 }
 
+// Progress keeps track of which tiles have been loaded completely, so that
+// they can be skipped when resuming.
+type Progress interface {
+	Done(step string) bool
+	MarkDone(step string)
+}
+
 type sequenceRetriever struct {
 	out           chan *Photo
 	lineStr       orb.LineString
 	conf          Config
 	seenSequences *sync.Map
+	seenImages    *sync.Map
+	progress      Progress
+	// conf.FilterNewer parsed, zero if not set
+	newer time.Time
+	// limits the image detail requests in flight, see acquireDetailSlot
+	detailSlots chan struct{}
+	ctx         context.Context
 }
 
-func FindSequences(mapConf Config, lineStr orb.LineString) <-chan *Photo {
+// FindSequences emits the photos around the line string. Once ctx is done, no
+// further tiles are read and the channel is closed. Tiles which were not read
+// completely are not marked as done. It fails if the filters are invalid.
+func FindSequences(ctx context.Context, mapConf Config, lineStr orb.LineString, progress Progress) (<-chan *Photo, error) {
+	var newer time.Time
+	if mapConf.FilterNewer != "" {
+		var err error
+		newer, err = time.Parse("2006-01-02", mapConf.FilterNewer)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse date filter: %v", err)
+		}
+	}
+
 	sr := sequenceRetriever{
-		out:           make(chan *Photo, 10),
+		// unbuffered, so that once a tile is marked as done all of its photos
+		// have been received
+		out:           make(chan *Photo),
 		lineStr:       lineStr,
 		conf:          mapConf,
 		seenSequences: &sync.Map{},
+		seenImages:    &sync.Map{},
+		progress:      progress,
+		newer:         newer,
+		detailSlots:   make(chan struct{}, maxDetailRequests),
+		ctx:           ctx,
 	}
 
 	sr.RetrieveTiles()
-	return sr.out
+	return sr.out, nil
 }
 
 func (s sequenceRetriever) RetrieveTiles() {
-	var wg sync.WaitGroup
-	tiles := s.Tiles()
+	tiles := s.pendingTiles()
 	log.Printf("Reading data for %d tiles", len(tiles))
 
 	bar := pb.StartNew(len(tiles))
+	stopQueueStatus := showQueueStatus(bar)
 
-	for _, tile := range tiles {
+	// a few workers instead of one goroutine per tile, so that big routes
+	// don't pile up requests waiting for the rate limit
+	queue := make(chan maptile.Tile)
+	var wg sync.WaitGroup
+	for i := 0; i < tileWorkers; i++ {
 		wg.Add(1)
-		go func(tile maptile.Tile) {
+		go func() {
 			defer wg.Done()
-			s.retrieveTile(tile)
-			bar.Increment()
-		}(tile)
+			for tile := range queue {
+				if s.retrieveAnyTile(tile) {
+					bar.Increment()
+				}
+			}
+		}()
 	}
 
+	go func() {
+		defer close(queue)
+		for _, tile := range tiles {
+			select {
+			case queue <- tile:
+			case <-s.ctx.Done():
+				return
+			}
+		}
+	}()
+
 	go func() {
 		wg.Wait()
+		stopQueueStatus()
 		close(s.out)
 		bar.Finish()
 	}()
 }
 
+// retrieveAnyTile reads the tile with the configured API and marks it as
+// done, unless it was interrupted or incomplete
+func (s sequenceRetriever) retrieveAnyTile(tile maptile.Tile) bool {
+	if s.ctx.Err() != nil {
+		return false
+	}
+	var complete bool
+	if s.conf.useV3() {
+		complete = s.retrieveTile(tile)
+	} else {
+		complete = s.retrieveCoverageTile(tile)
+	}
+	// an interrupted tile might be missing photos
+	if !complete || s.ctx.Err() != nil {
+		return false
+	}
+	s.progress.MarkDone(tileStep(tile))
+	return true
+}
+
+// acquireDetailSlot waits until fewer than maxDetailRequests image detail
+// requests are running. It returns false if ctx is done instead.
+func (s sequenceRetriever) acquireDetailSlot() bool {
+	select {
+	case s.detailSlots <- struct{}{}:
+		return true
+	case <-s.ctx.Done():
+		return false
+	}
+}
+
+func (s sequenceRetriever) releaseDetailSlot() {
+	<-s.detailSlots
+}
+
+// showQueueStatus shows the requests waiting for each host next to the
+// progress bar, until the returned func is called
+func showQueueStatus(bar *pb.ProgressBar) func() {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				bar.Postfix(queueStatus())
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+func queueStatus() string {
+	var parts []string
+	for _, q := range browser.Queues() {
+		if q.Waiting == 0 && q.Active == 0 {
+			continue
+		}
+		parts = append(parts, fmt.Sprintf("%s: %d queued, %d active, %.1f/s", q.Host, q.Waiting, q.Active, q.Rate))
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return " " + strings.Join(parts, "; ")
+}
+
+// Tiles lists the tiles within SearchRadius of the track. It looks around
+// points along the track which are closer together than that, so that long
+// segments don't skip the tiles between their ends.
 func (s sequenceRetriever) Tiles() []maptile.Tile {
-	tilesMap := make(map[maptile.Tile]struct{})
-	for _, pt := range s.lineStr {
-		tile := maptile.At(pt, gridZoomLevel)
-		tilesMap[tile] = struct{}{}
+	zoom := maptile.Zoom(gridZoomLevel)
+	if !s.conf.useV3() {
+		zoom = coverageZoomLevel
+	}
+	tilesMap := make(maptile.Set)
+	for _, pt := range cheapruler.EveryN(s.lineStr, SearchRadius) {
+		// the track between two points is at most half the step away
+		around := geo.NewBoundAroundPoint(pt, 1.5*SearchRadius)
+		for tile := range tilecover.Bound(around, zoom) {
+			tilesMap[tile] = true
+		}
 	}
 	tiles := make([]maptile.Tile, 0, len(tilesMap))
-	for tile, _ := range tilesMap {
+	for tile := range tilesMap {
 		tiles = append(tiles, tile)
 	}
 	return tiles
 }
 
-func (s sequenceRetriever) retrieveTile(t maptile.Tile) {
+func (s sequenceRetriever) pendingTiles() []maptile.Tile {
+	all := s.Tiles()
+	pending := make([]maptile.Tile, 0, len(all))
+	for _, tile := range all {
+		if !s.progress.Done(tileStep(tile)) {
+			pending = append(pending, tile)
+		}
+	}
+	if skipped := len(all) - len(pending); skipped > 0 {
+		log.Printf("Skipping %d tiles that were loaded before", skipped)
+	}
+	return pending
+}
+
+func tileStep(t maptile.Tile) string {
+	return fmt.Sprintf("tile/%d/%d/%d", t.Z, t.X, t.Y)
+}
+
+// retrieveTile finds the sequences in a tile using the v3 API. It returns
+// false if some of their photos could not be read.
+func (s sequenceRetriever) retrieveTile(t maptile.Tile) bool {
 	bbox := t.Bound(tileBuffer)
 	bboxstr := fmt.Sprintf("%f,%f,%f,%f", bbox.Left(), bbox.Bottom(), bbox.Right(), bbox.Top())
-	seqs := getApi(s.conf, "sequences", "per_page=1000&bbox="+bboxstr)
+	seqs, ok := getApi(s.ctx, s.conf, "sequences", "per_page=1000&bbox="+bboxstr)
+	if !ok || seqs == "" {
+		return ok
+	}
 
 	fc, err := geojson.UnmarshalFeatureCollection([]byte(seqs))
 	if err != nil {
 		log.Printf("Failed to parse feature collection: %v", err)
-		return
+		return true
 	}
 
 	var wg sync.WaitGroup
+	var incomplete int32
 	for _, feat := range fc.Features {
 		seqkey := fmt.Sprintf("%s", feat.Properties["key"])
 		_, loaded := s.seenSequences.LoadOrStore(seqkey, true)
@@ -104,16 +264,17 @@ func (s sequenceRetriever) retrieveTile(t maptile.Tile) {
 		err := mapstructure.Decode(feat.Properties["coordinateProperties"], &cp)
 		if err != nil {
 			log.Printf("Failed to parse coordinateProperties from Mapillary sequence: %v", err)
-			return
+			continue
 		}
 
 		ls := g.(orb.LineString)
-		s.makePhotos(seqkey, cp.Image_keys, ls, cp.Cas, &wg)
+		s.makePhotos(seqkey, cp.Image_keys, ls, cp.Cas, &wg, &incomplete)
 	}
 	wg.Wait()
+	return atomic.LoadInt32(&incomplete) == 0
 }
 
-func (s sequenceRetriever) makePhotos(seq string, imgKeys []string, ls orb.LineString, cas []float64, wg *sync.WaitGroup) {
+func (s sequenceRetriever) makePhotos(seq string, imgKeys []string, ls orb.LineString, cas []float64, wg *sync.WaitGroup, incomplete *int32) {
 	// Mapillary data is not always consistent
 	maxLen := min(len(imgKeys), len(ls), len(cas))
 
@@ -123,14 +284,27 @@ func (s sequenceRetriever) makePhotos(seq string, imgKeys []string, ls orb.LineS
 			end = maxLen
 		}
 
+		if !s.acquireDetailSlot() {
+			atomic.StoreInt32(incomplete, 1)
+			return
+		}
 		wg.Add(1)
 		go func(imgKeyChunk []string, lsChunk []orb.Point, casChunk []float64) {
 			defer wg.Done()
+			defer s.releaseDetailSlot()
 
-			detailsChunk := getImageByKeys(s.conf, imgKeyChunk)
+			detailsChunk, ok := getImageByKeys(s.ctx, s.conf, imgKeyChunk)
+			if !ok {
+				atomic.StoreInt32(incomplete, 1)
+				return
+			}
 
 			for j := 0; j < len(imgKeyChunk); j++ {
-				details := detailsChunk[imgKeyChunk[j]]
+				// without details the location and angle would be zero
+				details, found := detailsChunk[imgKeyChunk[j]]
+				if !found {
+					continue
+				}
 				pic := Photo{
 					Key:            imgKeyChunk[j],
 					OrgCameraAngle: casChunk[j],
@@ -142,12 +316,24 @@ func (s sequenceRetriever) makePhotos(seq string, imgKeys []string, ls orb.LineS
 				pic.SetOrgLocation(lsChunk[j])
 				pic.SetLocation(details.SfmPoint())
 				pic.DistFromPath = cheapruler.LineDist(s.lineStr, pic.Point())
-				s.out <- &pic
+				if !s.emit(&pic) {
+					return
+				}
 			}
 		}(imgKeys[i:end], ls[i:end], cas[i:end])
 	}
 }
 
+// emit passes the photo on. It returns false if ctx is done instead.
+func (s sequenceRetriever) emit(pic *Photo) bool {
+	select {
+	case s.out <- pic:
+		return true
+	case <-s.ctx.Done():
+		return false
+	}
+}
+
 func min(x, y, z int) int {
 	if x < y && x < z {
 		return x
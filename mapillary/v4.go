@@ -0,0 +1,238 @@
+package mapillary
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/breunigs/photoepics/cheapruler"
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/encoding/mvt"
+	"github.com/paulmach/orb/maptile"
+)
+
+// name of the layer in the coverage tiles that contains single images. The
+// tiles also have a sequence layer, but it is not needed: each image names
+// its sequence, and images are deduplicated by key across tiles already. The
+// sequences' lines are cut at the tile's edge and don't list their images,
+// so they can't replace the image layer either.
+const imageLayer = "image"
+
+// fields requested from the Graph API for each image
+const graphImageFields = "id,sequence,captured_at,compass_angle,computed_compass_angle,geometry,computed_geometry,merge_cc,creator"
+
+type graphPoint struct {
+	Coordinates []float64 `json:"coordinates"`
+}
+
+func (gp *graphPoint) valid() bool {
+	return gp != nil && len(gp.Coordinates) >= 2
+}
+
+func (gp *graphPoint) point() orb.Point {
+	return orb.Point{gp.Coordinates[0], gp.Coordinates[1]}
+}
+
+type graphImage struct {
+	ID                   string      `json:"id"`
+	Sequence             string      `json:"sequence"`
+	CapturedAt           int64       `json:"captured_at"`
+	CompassAngle         float64     `json:"compass_angle"`
+	ComputedCompassAngle *float64    `json:"computed_compass_angle"`
+	Geometry             *graphPoint `json:"geometry"`
+	ComputedGeometry     *graphPoint `json:"computed_geometry"`
+	MergeCC              int64       `json:"merge_cc"`
+	Creator              struct {
+		Username string `json:"username"`
+	} `json:"creator"`
+}
+
+type graphImages struct {
+	Data []graphImage `json:"data"`
+}
+
+// retrieveCoverageTile finds the images in a v4 coverage tile and reads their
+// details from the Graph API. It returns false if some of them could not be
+// read.
+func (s sequenceRetriever) retrieveCoverageTile(t maptile.Tile) bool {
+	url := fmt.Sprintf("%s%d/%d/%d?access_token=%s", s.conf.tilesBaseUrl(), t.Z, t.X, t.Y, s.conf.APIKey)
+	body, ok := get(s.ctx, s.conf, url)
+	if !ok {
+		return false
+	}
+
+	// an empty body means there's no imagery in this tile
+	if body == "" {
+		return true
+	}
+
+	layers, err := decodeTile([]byte(body))
+	if err != nil {
+		log.Printf("Failed to parse coverage tile %d/%d/%d: %v", t.Z, t.X, t.Y, err)
+		return true
+	}
+	layers.ProjectToWGS84(t)
+
+	var imgKeys []string
+	for _, layer := range layers {
+		if layer.Name != imageLayer {
+			continue
+		}
+		for _, feat := range layer.Features {
+			key := propertyString(feat.Properties["id"])
+			if key == "" {
+				continue
+			}
+			if !s.capturedInRange(feat.Properties["captured_at"]) {
+				continue
+			}
+			if _, loaded := s.seenImages.LoadOrStore(key, true); loaded {
+				// neighbouring tile returned the same image
+				continue
+			}
+			imgKeys = append(imgKeys, key)
+		}
+	}
+
+	var wg sync.WaitGroup
+	var incomplete int32
+	for i := 0; i < len(imgKeys); i += imageDetailsChunkSize {
+		end := i + imageDetailsChunkSize
+		if end > len(imgKeys) {
+			end = len(imgKeys)
+		}
+
+		if !s.acquireDetailSlot() {
+			atomic.StoreInt32(&incomplete, 1)
+			break
+		}
+		wg.Add(1)
+		go func(chunk []string) {
+			defer wg.Done()
+			defer s.releaseDetailSlot()
+			imgs, ok := getGraphImages(s.ctx, s.conf, chunk)
+			if !ok {
+				atomic.StoreInt32(&incomplete, 1)
+				return
+			}
+			for _, img := range imgs {
+				pic, ok := s.makeGraphPhoto(img)
+				if ok && !s.emit(pic) {
+					return
+				}
+			}
+		}(imgKeys[i:end])
+	}
+	wg.Wait()
+	return atomic.LoadInt32(&incomplete) == 0
+}
+
+func (s sequenceRetriever) makeGraphPhoto(img graphImage) (*Photo, bool) {
+	if !img.Geometry.valid() {
+		log.Printf("Mapillary image %s has no location, skipping", img.ID)
+		return nil, false
+	}
+	if !s.createdByFilteredUser(img.Creator.Username) {
+		return nil, false
+	}
+
+	pic := Photo{
+		Key:            img.ID,
+		OrgCameraAngle: img.CompassAngle,
+		CameraAngle:    img.CompassAngle,
+		Captured:       time.Unix(img.CapturedAt/1000, 0),
+		MergeCC:        img.MergeCC,
+		Sequence:       img.Sequence,
+	}
+	if img.ComputedCompassAngle != nil {
+		pic.CameraAngle = *img.ComputedCompassAngle
+	}
+	pic.SetOrgLocation(img.Geometry.point())
+	if img.ComputedGeometry.valid() {
+		pic.SetLocation(img.ComputedGeometry.point())
+	} else {
+		pic.SetLocation(img.Geometry.point())
+	}
+	pic.DistFromPath = cheapruler.LineDist(s.lineStr, pic.Point())
+	return &pic, true
+}
+
+// capturedInRange checks the capture time from the coverage tile, so that
+// images which are too old don't need to be looked up
+func (s sequenceRetriever) capturedInRange(capturedAt interface{}) bool {
+	if s.newer.IsZero() {
+		return true
+	}
+	ms, ok := capturedAt.(float64)
+	if !ok {
+		return true
+	}
+	return !time.Unix(int64(ms)/1000, 0).Before(s.newer)
+}
+
+// the coverage tiles only know the creator's ID, so usernames are compared
+// once the details have been read
+func (s sequenceRetriever) createdByFilteredUser(username string) bool {
+	if s.conf.FilterUsers == "" {
+		return true
+	}
+	for _, user := range strings.Split(s.conf.FilterUsers, ",") {
+		if user == username {
+			return true
+		}
+	}
+	return false
+}
+
+func getGraphImages(ctx context.Context, conf Config, imageKeys []string) ([]graphImage, bool) {
+	url := conf.graphBaseUrl() + "images"
+	url += "?access_token=" + conf.APIKey
+	url += "&image_ids=" + strings.Join(imageKeys, ",")
+	url += "&fields=" + graphImageFields
+	body, ok := get(ctx, conf, url)
+	if !ok || body == "" {
+		return nil, ok
+	}
+
+	res := graphImages{}
+	err := json.Unmarshal([]byte(body), &res)
+	if err != nil {
+		log.Fatalf("Unexpected output for images: %+v", err)
+	}
+	return res.Data, true
+}
+
+// tiles may still be gzipped if the server did not set Content-Encoding
+func decodeTile(data []byte) (mvt.Layers, error) {
+	if len(data) > 2 && data[0] == 0x1f && data[1] == 0x8b {
+		return mvt.UnmarshalGzipped(data)
+	}
+	return mvt.Unmarshal(data)
+}
+
+// float64 represents all integers up to this exactly
+const maxExactInteger = 1 << 53
+
+// MVT decodes all numbers as float64, but IDs are better handled as strings.
+// IDs which may have been rounded while decoding are skipped.
+func propertyString(v interface{}) string {
+	switch val := v.(type) {
+	case string:
+		return val
+	case float64:
+		if val != math.Trunc(val) || math.Abs(val) > maxExactInteger {
+			log.Printf("Skipping image with ID %v, it cannot be read exactly from the coverage tile", val)
+			return ""
+		}
+		return strconv.FormatFloat(val, 'f', -1, 64)
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,23 @@
+package mapillary
+
+import "testing"
+
+func TestPropertyString(t *testing.T) {
+	tests := []struct {
+		value interface{}
+		want  string
+	}{
+		{"123", "123"},
+		{float64(4321), "4321"},
+		// Mapillary's IDs have up to 16 digits
+		{float64(1234567890123456), "1234567890123456"},
+		{float64(1<<53 + 2), ""},
+		{1.5, ""},
+		{true, ""},
+	}
+	for _, tt := range tests {
+		if got := propertyString(tt.value); got != tt.want {
+			t.Errorf("propertyString(%v) = %q, expected %q", tt.value, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package mapillary_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/breunigs/photoepics/mapillary"
+	"github.com/breunigs/photoepics/mapillary/fake"
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+)
+
+// the fixtures' sequences by user
+const (
+	aliceSequence = "fakeSequenceA000000001"
+	bobSequence   = "fakeSequenceB000000001"
+)
+
+// startFake serves the fixtures in dir with a v4 config
+func startFake(t *testing.T, dir string) (*fake.Harness, mapillary.Config) {
+	h, err := fake.NewHarness(dir)
+	if err != nil {
+		t.Fatalf("Failed to load fixtures: %v", err)
+	}
+	return h, h.Config("v4")
+}
+
+// graphRequests returns the image IDs of each Graph API request
+func graphRequests(fetcher *fake.RecordingFetcher) [][]string {
+	var ids [][]string
+	for _, u := range fetcher.URLs() {
+		if strings.HasSuffix(u.Path, "/images") {
+			ids = append(ids, strings.Split(u.Query().Get("image_ids"), ","))
+		}
+	}
+	return ids
+}
+
+// tileRequests counts all other requests, since v4 only reads tiles besides
+// the Graph API
+func tileRequests(fetcher *fake.RecordingFetcher) int {
+	return len(fetcher.URLs()) - len(graphRequests(fetcher))
+}
+
+func findPhotos(t *testing.T, conf mapillary.Config, line orb.LineString) map[string]mapillary.Photo {
+	found, err := fake.FindPhotos(conf, line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, p := range found {
+		p.DistFromPath = 0
+		found[key] = p
+	}
+	return found
+}
+
+func TestCoverageTiles(t *testing.T) {
+	h, conf := startFake(t, "fake/fixtures")
+	defer h.Close()
+
+	tracks := map[string]orb.LineString{
+		"track": h.Track,
+		// the photos are all in tiles between the two points
+		"long segment": {{13.33, 52.5165}, {13.40, 52.5166}},
+	}
+	for name, line := range tracks {
+		t.Run(name, func(t *testing.T) {
+			found := findPhotos(t, conf, line)
+			want := h.Fixtures.Photos()
+			if len(found) != len(want) {
+				t.Errorf("Found %d photos, expected %d", len(found), len(want))
+			}
+			for _, w := range want {
+				if got := found[w.Key]; !reflect.DeepEqual(got, w) {
+					t.Errorf("Photo %s differs from the fixtures:\n got: %+v\nwant: %+v", w.Key, got, w)
+				}
+			}
+		})
+	}
+}
+
+// writeFixtures creates a single sequence with n images along a track
+func writeFixtures(t *testing.T, n int) string {
+	dir, err := ioutil.TempDir("", "photoepics")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ls orb.LineString
+	var keys []string
+	var cas []float64
+	images := make(map[string]fake.Image)
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("C%021d", i)
+		pt := orb.Point{13.3777 + float64(i)*0.00001, 52.5165}
+		ls = append(ls, pt)
+		keys = append(keys, key)
+		cas = append(cas, 90)
+
+		img := fake.Image{CapturedAt: 1600000000000 + int64(i)*1000, MergeCC: 1, CameraAngle: 91}
+		img.Location.Lon, img.Location.Lat = pt[0], pt[1]
+		images[key] = img
+	}
+
+	seq := geojson.NewFeature(ls)
+	seq.Properties["key"] = "fakeSequenceC000000001"
+	seq.Properties["username"] = "carol"
+	seq.Properties["coordinateProperties"] = map[string]interface{}{"image_keys": keys, "cas": cas}
+	fc := geojson.NewFeatureCollection().Append(seq)
+	track := geojson.NewFeatureCollection().Append(geojson.NewFeature(ls))
+
+	files := map[string]interface{}{fake.SequencesFile: fc, fake.ImagesFile: images, fake.TrackFile: track}
+	for file, v := range files {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, file), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestGraphImagesBatching(t *testing.T) {
+	const images = 250
+	dir := writeFixtures(t, images)
+	defer os.RemoveAll(dir)
+	h, conf := startFake(t, dir)
+	defer h.Close()
+
+	found := findPhotos(t, conf, h.Track)
+	if len(found) != images {
+		t.Errorf("Found %d photos, expected %d", len(found), images)
+	}
+
+	requests := graphRequests(h.Fetcher)
+	if len(requests) != 3 {
+		t.Errorf("Sent %d Graph API requests, expected 3", len(requests))
+	}
+	requested := make(map[string]bool)
+	for _, ids := range requests {
+		if len(ids) > 100 {
+			t.Errorf("Requested %d images at once, expected at most 100", len(ids))
+		}
+		for _, id := range ids {
+			if requested[id] {
+				t.Errorf("Image %s was requested twice", id)
+			}
+			requested[id] = true
+		}
+	}
+	if len(requested) != images {
+		t.Errorf("Requested %d images, expected %d", len(requested), images)
+	}
+}
+
+func TestFilters(t *testing.T) {
+	h, conf := startFake(t, "fake/fixtures")
+	defer h.Close()
+
+	tests := []struct {
+		name     string
+		users    string
+		newer    string
+		sequence string
+	}{
+		{"users", "alice", "", aliceSequence},
+		// alice's sequence is from 2019, bob's from 2020
+		{"newer", "", "2020-01-01", bobSequence},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h.Fetcher.Reset()
+			conf := conf
+			conf.FilterUsers = tt.users
+			conf.FilterNewer = tt.newer
+			found := findPhotos(t, conf, h.Track)
+
+			want := 0
+			for _, p := range h.Fixtures.Photos() {
+				if p.Sequence == tt.sequence {
+					want++
+				}
+			}
+			if len(found) != want {
+				t.Errorf("Found %d photos, expected %d", len(found), want)
+			}
+			for key, p := range found {
+				if p.Sequence != tt.sequence {
+					t.Errorf("Photo %s of sequence %s was not filtered", key, p.Sequence)
+				}
+			}
+
+			// the capture time is in the tiles, so old images are not
+			// looked up at all
+			if tt.newer == "" {
+				return
+			}
+			for _, ids := range graphRequests(h.Fetcher) {
+				for _, id := range ids {
+					if !strings.HasPrefix(id, "B") {
+						t.Errorf("Image %s is too old, but its details were requested", id)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestMissingAndEmptyTiles(t *testing.T) {
+	h, conf := startFake(t, "fake/fixtures")
+	defer h.Close()
+
+	missing := conf
+	missing.TilesBaseURL = strings.Replace(conf.TilesBaseURL, "/tiles/", "/missing/", 1)
+	hamburg := orb.LineString{{9.99, 53.55}, {10.0, 53.551}}
+
+	tests := []struct {
+		name string
+		conf mapillary.Config
+		line orb.LineString
+	}{
+		{"not found", missing, h.Track},
+		{"empty", conf, hamburg},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h.Fetcher.Reset()
+			if found := findPhotos(t, tt.conf, tt.line); len(found) != 0 {
+				t.Errorf("Found %d photos, expected none", len(found))
+			}
+			if tileRequests(h.Fetcher) == 0 {
+				t.Errorf("No tiles were requested")
+			}
+			if requests := graphRequests(h.Fetcher); len(requests) != 0 {
+				t.Errorf("Sent %d Graph API requests, expected none", len(requests))
+			}
+		})
+	}
+}
+
+func TestInvalidDateFilter(t *testing.T) {
+	h, conf := startFake(t, "fake/fixtures")
+	defer h.Close()
+
+	conf.FilterNewer = "01.01.2020"
+	if _, err := fake.FindPhotos(conf, h.Track); err == nil {
+		t.Errorf("Expected an error for date filter %q", conf.FilterNewer)
+	}
+}
@@ -0,0 +1,338 @@
+package memory
+
+import (
+	"encoding/gob"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/breunigs/photoepics/cheapruler"
+	"github.com/breunigs/photoepics/mapillary"
+	"github.com/breunigs/photoepics/store"
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/maptile"
+)
+
+// Store implements store.Store entirely in memory. If a path is given, the
+// data is read from there on start and written back on Close, so that
+// separate invocations can share it. While steps are marked as done, it is
+// also written every snapshotInterval, so that a load which fails without
+// calling Close can be resumed from there.
+type Store struct {
+	path string
+	// when MarkDone last wrote the snapshot
+	lastSave time.Time
+
+	mu       sync.RWMutex
+	photos   map[string]mapillary.Photo
+	grid     map[maptile.Tile][]string
+	sessions map[string]*session
+}
+
+type session struct {
+	Track  orb.LineString
+	Dist   map[string]float64
+	Edges  map[string][]store.Edge
+	NEdges int64
+	Done   map[string]bool
+}
+
+// how often MarkDone writes the snapshot at most. Writing it holds the lock
+// and takes longer the more photos are stored, so it is not done for every
+// batch.
+const snapshotInterval = time.Minute
+
+// what gets written to disk. The grid is rebuilt on load.
+type snapshot struct {
+	Photos   map[string]mapillary.Photo
+	Sessions map[string]*session
+}
+
+func New(path string) *Store {
+	s := &Store{path: path}
+	s.reset()
+
+	if path == "" {
+		return s
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return s
+	}
+	if err != nil {
+		log.Fatalf("Failed to open in-memory DB snapshot %s: %+v", path, err)
+	}
+	defer f.Close()
+
+	var snap snapshot
+	if err := gob.NewDecoder(f).Decode(&snap); err != nil {
+		log.Fatalf("Failed to read in-memory DB snapshot %s: %+v", path, err)
+	}
+
+	for key, p := range snap.Photos {
+		s.photos[key] = p
+		cell := store.GridCell(p.Point())
+		s.grid[cell] = append(s.grid[cell], key)
+	}
+	for name, sess := range snap.Sessions {
+		if sess.Done == nil {
+			sess.Done = make(map[string]bool)
+		}
+		s.sessions[name] = sess
+	}
+	return s
+}
+
+func (s *Store) reset() {
+	s.photos = make(map[string]mapillary.Photo)
+	s.grid = make(map[maptile.Tile][]string)
+	s.sessions = make(map[string]*session)
+}
+
+func (s *Store) CreateSchema() {}
+
+func (s *Store) CreateSession(sess store.Session) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sessions[sess.Name] = &session{
+		Track: sess.Track,
+		Dist:  make(map[string]float64),
+		Edges: make(map[string][]store.Edge),
+		Done:  make(map[string]bool),
+	}
+}
+
+func (s *Store) Session(name string) (store.Session, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	sess, ok := s.sessions[name]
+	if !ok {
+		return store.Session{}, false
+	}
+	return store.Session{Name: name, Track: sess.Track}, true
+}
+
+func (s *Store) Sessions() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	names := make([]string, 0, len(s.sessions))
+	for name := range s.sessions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *Store) DeleteSession(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, name)
+}
+
+func (s *Store) MarkDone(sessionName string, steps []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sess := s.session(sessionName)
+	for _, step := range steps {
+		sess.Done[step] = true
+	}
+	// a failing load exits without calling Close
+	if time.Since(s.lastSave) >= snapshotInterval {
+		s.save()
+		s.lastSave = time.Now()
+	}
+}
+
+func (s *Store) DoneSteps(sessionName string) map[string]bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	done := make(map[string]bool)
+	if sess, ok := s.sessions[sessionName]; ok {
+		for step := range sess.Done {
+			done[step] = true
+		}
+	}
+	return done
+}
+
+// must hold the lock when calling
+func (s *Store) session(name string) *session {
+	sess, ok := s.sessions[name]
+	if !ok {
+		log.Fatalf("Session %q does not exist", name)
+	}
+	return sess
+}
+
+func (s *Store) InsertPhotos(sessionName string, photos []*mapillary.Photo) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sess := s.session(sessionName)
+	for _, p := range photos {
+		if old, ok := s.photos[p.Key]; ok {
+			s.removeFromGrid(old)
+		}
+
+		// the image key is unique already, so use it as identifier
+		pic := *p
+		pic.Uid = p.Key
+		pic.DistFromPath = 0
+		s.photos[pic.Key] = pic
+		sess.Dist[pic.Key] = p.DistFromPath
+
+		cell := store.GridCell(pic.Point())
+		s.grid[cell] = append(s.grid[cell], pic.Key)
+	}
+}
+
+func (s *Store) removeFromGrid(p mapillary.Photo) {
+	cell := store.GridCell(p.Point())
+	keys := s.grid[cell]
+	for i, key := range keys {
+		if key == p.Key {
+			s.grid[cell] = append(keys[:i], keys[i+1:]...)
+			return
+		}
+	}
+}
+
+func (s *Store) PhotoByKey(key string) mapillary.Photo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	p, ok := s.photos[key]
+	if !ok {
+		log.Fatalf("Expected to find exactly one photo with key=%s, but found 0", key)
+	}
+	return p
+}
+
+func (s *Store) PhotosNear(sessionName string, pt orb.Point, radius float64) []mapillary.Photo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	sess := s.session(sessionName)
+	center := []float64{pt[0], pt[1]}
+	var near []mapillary.Photo
+	for _, cell := range store.GridCellsAround(pt, radius) {
+		for _, key := range s.grid[cell] {
+			dist, ok := sess.Dist[key]
+			if !ok {
+				continue
+			}
+			p := s.photos[key]
+			if cheapruler.Dist(center, p.Loc.Coords) <= radius {
+				p.DistFromPath = dist
+				near = append(near, p)
+			}
+		}
+	}
+	return near
+}
+
+func (s *Store) PhotoCount() int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return int64(len(s.photos))
+}
+
+func (s *Store) InsertEdges(sessionName string, edges []store.Edge) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sess := s.session(sessionName)
+	for _, e := range edges {
+		if !replaceEdge(sess.Edges[e.From], e) {
+			sess.Edges[e.From] = append(sess.Edges[e.From], e)
+			sess.NEdges++
+		}
+	}
+}
+
+// a resumed load might calculate the same edge again
+func replaceEdge(edges []store.Edge, e store.Edge) bool {
+	for i := range edges {
+		if edges[i].To == e.To {
+			edges[i] = e
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Store) EdgeCount(sessionName string) int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	sess, ok := s.sessions[sessionName]
+	if !ok {
+		return 0
+	}
+	return sess.NEdges
+}
+
+func (s *Store) ShortestPaths(sessionName string, from, to mapillary.Photo, n int, maxOverlap float64) []store.Path {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	sess := s.session(sessionName)
+	found := store.AlternativePaths(from.Uid, to.Uid, func(uid string) []store.Edge {
+		return sess.Edges[uid]
+	}, n, maxOverlap)
+
+	paths := make([]store.Path, len(found))
+	for i, f := range found {
+		photos := make([]mapillary.Photo, len(f.Uids))
+		for j, uid := range f.Uids {
+			photos[j] = s.photos[uid]
+			photos[j].DistFromPath = sess.Dist[uid]
+		}
+		paths[i] = store.Path{Photos: photos, Cost: f.Cost}
+	}
+	return paths
+}
+
+func (s *Store) PurgeEverything() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reset()
+}
+
+func (s *Store) Close() {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	s.save()
+}
+
+// must hold the lock when calling
+func (s *Store) save() {
+	if s.path == "" {
+		return
+	}
+
+	tmp := s.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		log.Fatalf("Failed to write in-memory DB snapshot %s: %+v", s.path, err)
+	}
+
+	snap := snapshot{Photos: s.photos, Sessions: s.sessions}
+	if err := gob.NewEncoder(f).Encode(snap); err != nil {
+		log.Fatalf("Failed to write in-memory DB snapshot %s: %+v", s.path, err)
+	}
+	if err := f.Close(); err != nil {
+		log.Fatalf("Failed to write in-memory DB snapshot %s: %+v", s.path, err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		log.Fatalf("Failed to write in-memory DB snapshot %s: %+v", s.path, err)
+	}
+}
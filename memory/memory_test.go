@@ -0,0 +1,103 @@
+package memory
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/breunigs/photoepics/cheapruler"
+	"github.com/breunigs/photoepics/mapillary"
+	"github.com/breunigs/photoepics/store"
+	"github.com/paulmach/orb"
+)
+
+func photo(key string, lon float64, dist float64) *mapillary.Photo {
+	p := &mapillary.Photo{
+		Key:         key,
+		Sequence:    "seq",
+		CameraAngle: 90,
+		MergeCC:     1,
+		Captured:    time.Unix(1600000000, 0).UTC(),
+	}
+	p.SetLocation(orb.Point{lon, 52.5165})
+	p.DistFromPath = dist
+	return p
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	cheapruler.Init(52.5165)
+	dir, err := ioutil.TempDir("", "photoepics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "epic.gob")
+
+	track := orb.LineString{{13.3777, 52.5165}, {13.3790, 52.5165}}
+	s := New(path)
+	s.CreateSession(store.Session{Name: "test", Track: track})
+	s.InsertPhotos("test", []*mapillary.Photo{photo("a", 13.3777, 1), photo("b", 13.3778, 2), photo("c", 13.3779, 3)})
+	s.InsertEdges("test", []store.Edge{{From: "a", To: "b", Weight: 1}, {From: "b", To: "c", Weight: 2}})
+	// MarkDone writes the snapshot right away the first time, since a
+	// failing load doesn't call Close
+	s.MarkDone("test", []string{"tile 1"})
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("MarkDone did not write the snapshot: %v", err)
+	}
+	s.MarkDone("test", []string{"tile 2"})
+	if got := New(path).DoneSteps("test"); !reflect.DeepEqual(got, map[string]bool{"tile 1": true}) {
+		t.Errorf("Snapshot written while marking steps has %v done, expected only the first", got)
+	}
+	s.Close()
+
+	s = New(path)
+	if got := s.Sessions(); !reflect.DeepEqual(got, []string{"test"}) {
+		t.Errorf("Got sessions %q, expected [test]", got)
+	}
+	if sess, ok := s.Session("test"); !ok || !reflect.DeepEqual(sess.Track, track) {
+		t.Errorf("Session track is %v, expected %v", sess.Track, track)
+	}
+	if got := s.DoneSteps("test"); !reflect.DeepEqual(got, map[string]bool{"tile 1": true, "tile 2": true}) {
+		t.Errorf("Got done steps %v, expected both tiles", got)
+	}
+	if got := s.PhotoCount(); got != 3 {
+		t.Errorf("Got %d photos, expected 3", got)
+	}
+	if got := s.EdgeCount("test"); got != 2 {
+		t.Errorf("Got %d edges, expected 2", got)
+	}
+
+	want := *photo("b", 13.3778, 0)
+	want.Uid = "b"
+	if got := s.PhotoByKey("b"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Got photo\n%+v\nexpected\n%+v", got, want)
+	}
+
+	// the grid is rebuilt from the photos
+	near := s.PhotosNear("test", orb.Point{13.3778, 52.5165}, 5)
+	if len(near) != 1 || near[0].Key != "b" || near[0].DistFromPath != 2 {
+		t.Errorf("Got photos near b %+v, expected only b with its distance", near)
+	}
+
+	paths := s.ShortestPaths("test", s.PhotoByKey("a"), s.PhotoByKey("c"), 1, 0.5)
+	if len(paths) != 1 || paths[0].Cost != 3 || len(paths[0].Photos) != 3 {
+		t.Fatalf("Got paths %+v, expected a, b, c with cost 3", paths)
+	}
+	if got := paths[0].Photos[2]; got.Key != "c" || got.DistFromPath != 3 {
+		t.Errorf("Path ends at %s with distance %v, expected c with 3", got.Key, got.DistFromPath)
+	}
+}
+
+func TestWithoutPath(t *testing.T) {
+	s := New("")
+	s.CreateSession(store.Session{Name: "test", Track: orb.LineString{{13.3777, 52.5165}, {13.3790, 52.5165}}})
+	s.MarkDone("test", []string{"tile 1"})
+	s.Close()
+
+	if got := New("").Sessions(); len(got) != 0 {
+		t.Errorf("Got sessions %q without a path, expected none", got)
+	}
+}
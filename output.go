@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/breunigs/photoepics/mapillary"
+	"github.com/breunigs/photoepics/store"
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+	"github.com/tkrajina/gpxgo/gpx"
+)
+
+const emptyImageKey = "           ?          "
+
+var chainWriters = map[string]func(io.Writer, []store.Path) error{
+	"text":    writeChainsText,
+	"json":    writeChainsJSON,
+	"geojson": writeChainsGeoJSON,
+	"gpx":     writeChainsGPX,
+	"csv":     writeChainsCSV,
+}
+
+func chainFormats() []string {
+	formats := make([]string, 0, len(chainWriters))
+	for f := range chainWriters {
+		formats = append(formats, f)
+	}
+	sort.Strings(formats)
+	return formats
+}
+
+func writeChains(w io.Writer, format string, paths []store.Path) error {
+	return chainWriters[format](w, paths)
+}
+
+// segment is a part of a chain that stays within a single sequence
+type segment struct {
+	Seq  string `json:"seq"`
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+func segments(path []mapillary.Photo) []segment {
+	var segs []segment
+	for _, pic := range path {
+		last := len(segs) - 1
+		if last >= 0 && segs[last].Seq == pic.Sequence {
+			segs[last].To = pic.Key
+			continue
+		}
+		segs = append(segs, segment{Seq: pic.Sequence, From: pic.Key, To: pic.Key})
+	}
+	return segs
+}
+
+type photoJSON struct {
+	Key          string    `json:"key"`
+	Sequence     string    `json:"sequence"`
+	Lon          float64   `json:"lon"`
+	Lat          float64   `json:"lat"`
+	Captured     time.Time `json:"captured"`
+	CameraAngle  float64   `json:"cameraAngle"`
+	DistFromPath float64   `json:"distFromPath"`
+}
+
+type chainJSON struct {
+	Cost     float64     `json:"cost"`
+	Segments []segment   `json:"segments"`
+	Photos   []photoJSON `json:"photos"`
+}
+
+func writeChainsJSON(w io.Writer, paths []store.Path) error {
+	chains := make([]chainJSON, len(paths))
+	for i, path := range paths {
+		photos := make([]photoJSON, len(path.Photos))
+		for j, pic := range path.Photos {
+			photos[j] = photoJSON{
+				Key:          pic.Key,
+				Sequence:     pic.Sequence,
+				Lon:          pic.Lon(),
+				Lat:          pic.Lat(),
+				Captured:     pic.Captured,
+				CameraAngle:  pic.CameraAngle,
+				DistFromPath: pic.DistFromPath,
+			}
+		}
+		chains[i] = chainJSON{
+			Cost:     path.Cost,
+			Segments: segments(path.Photos),
+			Photos:   photos,
+		}
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(chains)
+}
+
+func writeChainsGeoJSON(w io.Writer, paths []store.Path) error {
+	fc := geojson.NewFeatureCollection()
+	for i, path := range paths {
+		ls := make(orb.LineString, len(path.Photos))
+		for j, pic := range path.Photos {
+			ls[j] = pic.Point()
+
+			pt := geojson.NewFeature(pic.Point())
+			pt.Properties["chain"] = i
+			pt.Properties["key"] = pic.Key
+			pt.Properties["sequence"] = pic.Sequence
+			pt.Properties["captured"] = pic.RFC3339()
+			pt.Properties["cameraAngle"] = pic.CameraAngle
+			pt.Properties["distFromPath"] = pic.DistFromPath
+			fc.Append(pt)
+		}
+
+		line := geojson.NewFeature(ls)
+		line.Properties["chain"] = i
+		line.Properties["cost"] = path.Cost
+		fc.Append(line)
+	}
+
+	out, err := json.MarshalIndent(fc, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", out)
+	return err
+}
+
+func writeChainsGPX(w io.Writer, paths []store.Path) error {
+	g := gpx.GPX{Creator: "photoepics"}
+	for i, path := range paths {
+		for _, pic := range path.Photos {
+			wpt := gpx.GPXPoint{
+				Name:        pic.Key,
+				Description: "sequence " + pic.Sequence,
+				Timestamp:   pic.Captured,
+			}
+			wpt.Latitude = pic.Lat()
+			wpt.Longitude = pic.Lon()
+			if len(paths) > 1 {
+				wpt.Type = fmt.Sprintf("chain %d", i+1)
+			}
+			g.Waypoints = append(g.Waypoints, wpt)
+		}
+	}
+
+	out, err := g.ToXml(gpx.ToXmlParams{Version: "1.1", Indent: true})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(out)
+	return err
+}
+
+func writeChainsCSV(w io.Writer, paths []store.Path) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"chain", "index", "key", "sequence", "lon", "lat", "captured", "cameraAngle", "distFromPath"})
+	for i, path := range paths {
+		for j, pic := range path.Photos {
+			cw.Write([]string{
+				strconv.Itoa(i),
+				strconv.Itoa(j),
+				pic.Key,
+				pic.Sequence,
+				strconv.FormatFloat(pic.Lon(), 'f', -1, 64),
+				strconv.FormatFloat(pic.Lat(), 'f', -1, 64),
+				pic.RFC3339(),
+				strconv.FormatFloat(pic.CameraAngle, 'f', -1, 64),
+				strconv.FormatFloat(pic.DistFromPath, 'f', -1, 64),
+			})
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func writeChainsText(w io.Writer, paths []store.Path) error {
+	for i, path := range paths {
+		if len(paths) > 1 {
+			fmt.Fprintf(w, "\n\n### Chain %d of %d", i+1, len(paths))
+		}
+		fmt.Fprintf(w, "\n\nTotal cost: %.1f (%d images)", path.Cost, len(path.Photos))
+		writePathText(w, path.Photos)
+	}
+	return nil
+}
+
+func writePathText(w io.Writer, path []mapillary.Photo) {
+	// full list
+	fmt.Fprintln(w, "\n\nDB UID     SEQUENCE KEY             IMAGE KEY")
+	for _, pic := range path {
+		fmt.Fprintf(w, "(%s) %s:  %s\n", pic.Uid, pic.Sequence, pic.Key)
+	}
+
+	// abbreviated
+	fmt.Fprintln(w, "\n\nSummarized")
+	prevSeq := ""
+	seqStart := emptyImageKey
+	seqEnd := emptyImageKey
+	first := true
+	for _, pic := range path {
+		if prevSeq == pic.Sequence {
+			seqEnd = pic.Key
+			continue
+		}
+
+		if prevSeq != "" {
+			lineEnd := "\n"
+			if seqStart == seqEnd {
+				if first {
+					seqStart = emptyImageKey
+				} else {
+					lineEnd = " // single image\n"
+				}
+			}
+			first = false
+			fmt.Fprint(w, `{ "seq": "`+prevSeq+`", "from": "`+seqStart+`", "to": "`+seqEnd+`" },`+lineEnd)
+		}
+
+		prevSeq = pic.Sequence
+		seqStart = pic.Key
+		seqEnd = seqStart
+	}
+	fmt.Fprintln(w, `{ "seq": "`+prevSeq+`", "from": "`+seqStart+`", "to": "`+emptyImageKey+`" },`)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/breunigs/photoepics/mapillary"
+	"github.com/breunigs/photoepics/store"
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+)
+
+var captured = time.Date(2020, 6, 1, 10, 0, 0, 0, time.UTC)
+
+func chainPhoto(key, seq string, lon float64) mapillary.Photo {
+	p := mapillary.Photo{Key: key, Sequence: seq, CameraAngle: 90.5, Captured: captured, DistFromPath: 1.25}
+	p.SetLocation(orb.Point{lon, 52.5165})
+	return p
+}
+
+// two chains, the first switches sequences once
+var chains = []store.Path{
+	{Cost: 2.5, Photos: []mapillary.Photo{chainPhoto("a1", "A", 13.3777), chainPhoto("a2", "A", 13.3778), chainPhoto("b1", "B", 13.3779)}},
+	{Cost: 4, Photos: []mapillary.Photo{chainPhoto("c1", "C", 13.3777), chainPhoto("c2", "C", 13.3779)}},
+}
+
+func TestChainFormats(t *testing.T) {
+	want := []string{"csv", "geojson", "gpx", "json", "text"}
+	if got := chainFormats(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Got formats %q, expected %q", got, want)
+	}
+}
+
+func TestWriteChainsJSON(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeChains(&buf, "json", chains); err != nil {
+		t.Fatal(err)
+	}
+	var got []chainJSON
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("Output is no JSON array of chains: %v\n%s", err, buf.String())
+	}
+
+	if len(got) != 2 || got[0].Cost != 2.5 || got[1].Cost != 4 {
+		t.Fatalf("Got chains %+v, expected two with costs 2.5 and 4", got)
+	}
+	wantSegs := []segment{{Seq: "A", From: "a1", To: "a2"}, {Seq: "B", From: "b1", To: "b1"}}
+	if !reflect.DeepEqual(got[0].Segments, wantSegs) {
+		t.Errorf("Got segments %+v, expected %+v", got[0].Segments, wantSegs)
+	}
+	wantPhoto := photoJSON{Key: "a2", Sequence: "A", Lon: 13.3778, Lat: 52.5165, Captured: captured, CameraAngle: 90.5, DistFromPath: 1.25}
+	if len(got[0].Photos) != 3 || !reflect.DeepEqual(got[0].Photos[1], wantPhoto) {
+		t.Errorf("Got photos %+v, expected %+v second", got[0].Photos, wantPhoto)
+	}
+}
+
+func TestWriteChainsGeoJSON(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeChains(&buf, "geojson", chains); err != nil {
+		t.Fatal(err)
+	}
+	fc, err := geojson.UnmarshalFeatureCollection(buf.Bytes())
+	if err != nil {
+		t.Fatalf("Output is no FeatureCollection: %v\n%s", err, buf.String())
+	}
+
+	// each chain is its points followed by the line
+	if len(fc.Features) != 7 {
+		t.Fatalf("Got %d features, expected 7", len(fc.Features))
+	}
+	line, ok := fc.Features[3].Geometry.(orb.LineString)
+	if !ok || len(line) != 3 || line[2] != (orb.Point{13.3779, 52.5165}) {
+		t.Errorf("Got first chain's line %v, expected the three photos", fc.Features[3].Geometry)
+	}
+	if props := fc.Features[3].Properties; props["chain"] != 0.0 || props["cost"] != 2.5 {
+		t.Errorf("Got line properties %v, expected chain 0 with cost 2.5", props)
+	}
+
+	pt := fc.Features[4]
+	if _, ok := pt.Geometry.(orb.Point); !ok {
+		t.Fatalf("Got %s for the second chain's first photo, expected a Point", pt.Geometry.GeoJSONType())
+	}
+	want := geojson.Properties{
+		"chain":        1.0,
+		"key":          "c1",
+		"sequence":     "C",
+		"captured":     "2020-06-01T10:00:00Z",
+		"cameraAngle":  90.5,
+		"distFromPath": 1.25,
+	}
+	if !reflect.DeepEqual(pt.Properties, want) {
+		t.Errorf("Got photo properties %v, expected %v", pt.Properties, want)
+	}
+}
+
+func TestWriteChainsGPX(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeChains(&buf, "gpx", chains); err != nil {
+		t.Fatal(err)
+	}
+
+	type wpt struct {
+		Lat  float64 `xml:"lat,attr"`
+		Lon  float64 `xml:"lon,attr"`
+		Time string  `xml:"time"`
+		Name string  `xml:"name"`
+		Desc string  `xml:"desc"`
+		Type string  `xml:"type"`
+	}
+	var gpx struct {
+		Wpts []wpt `xml:"wpt"`
+	}
+	if err := xml.Unmarshal(buf.Bytes(), &gpx); err != nil {
+		t.Fatalf("Output is no GPX: %v\n%s", err, buf.String())
+	}
+
+	if len(gpx.Wpts) != 5 {
+		t.Fatalf("Got %d waypoints, expected one per photo", len(gpx.Wpts))
+	}
+	want := wpt{Lat: 52.5165, Lon: 13.3777, Time: "2020-06-01T10:00:00Z", Name: "c1", Desc: "sequence C", Type: "chain 2"}
+	if got := gpx.Wpts[3]; !reflect.DeepEqual(got, want) {
+		t.Errorf("Got waypoint %+v, expected %+v", got, want)
+	}
+}
+
+func TestWriteChainsCSV(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeChains(&buf, "csv", chains[1:]); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := [][]string{
+		{"chain", "index", "key", "sequence", "lon", "lat", "captured", "cameraAngle", "distFromPath"},
+		{"0", "0", "c1", "C", "13.3777", "52.5165", "2020-06-01T10:00:00Z", "90.5", "1.25"},
+		{"0", "1", "c2", "C", "13.3779", "52.5165", "2020-06-01T10:00:00Z", "90.5", "1.25"},
+	}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("Got rows\n%q\nexpected\n%q", rows, want)
+	}
+}
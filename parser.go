@@ -1,32 +1,111 @@
 package main
 
 import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"math"
 	"os"
+	"path"
+	"strconv"
 	"strings"
 
 	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geo"
 	geojson "github.com/paulmach/orb/geojson"
 	"github.com/tkrajina/gpxgo/gpx"
 )
 
-func trackFromFile(filePath string, trackID int) (orb.LineString, error) {
+// track is a route read from an input file
+type track struct {
+	name string
+	line orb.LineString
+	// indices of the points that start a new segment, i.e. the line leading
+	// to them was not travelled. Only set when segments are joined.
+	gaps []int
+	// further details from the file, e.g. GeoJSON properties
+	properties map[string]string
+}
+
+// property returns the given detail of the track. The name is always known.
+func (t track) property(key string) (string, bool) {
+	if value, ok := t.properties[key]; ok {
+		return value, true
+	}
+	if key == "name" {
+		return t.name, true
+	}
+	return "", false
+}
+
+// trackOptions configure how the track is chosen from the input file
+type trackOptions struct {
+	// which track to use if the file has several: an index, a name or glob
+	// pattern, or "all". Empty means to ask.
+	selector string
+	// how to order the tracks when merging all of them, see mergeOrders
+	mergeOrder string
+	// only consider tracks with this property, as key=value
+	where string
+	// join the segments of a GPX track into one track with gaps, instead of
+	// offering each segment as a track of its own
+	joinSegments bool
+}
+
+// appendTrack adds the track to the list, unless it has fewer than two
+// points. A single point has no direction to follow.
+func appendTrack(tracks []track, t track) []track {
+	if len(t.line) < 2 {
+		return tracks
+	}
+	return append(tracks, t)
+}
+
+func trackFromFile(filePath string, opts trackOptions) (track, error) {
+	tracks, err := tracksFromFile(filePath, opts)
+	if err != nil {
+		return track{}, err
+	}
+	return chooseTrack(tracks, opts)
+}
+
+// tracksFromFile reads all tracks of the file that match opts.where
+func tracksFromFile(filePath string, opts trackOptions) ([]track, error) {
 	data, err := ioutil.ReadFile(filePath)
 	if err != nil {
 		return nil, err
 	}
 
+	var tracks []track
 	switch getFileEnding(filePath) {
 	case "gpx":
-		return parseGPX(data, trackID)
+		tracks, err = parseGPX(data, opts.joinSegments)
 	case "geojson":
-		return parseGeoJSON(data, trackID)
+		tracks, err = parseGeoJSON(data)
+	case "kml":
+		tracks, err = parseKML(data)
+	case "kmz":
+		tracks, err = parseKMZ(data)
+	case "fit":
+		tracks, err = parseFIT(data)
+	case "tcx":
+		tracks, err = parseTCX(data)
 	default:
 		return nil, errors.New("Unknown file extension")
 	}
+	if err != nil {
+		return nil, err
+	}
+	if opts.where != "" {
+		return filterTracks(tracks, opts.where)
+	}
+	return tracks, nil
 }
 
 func getFileEnding(path string) string {
@@ -35,81 +114,561 @@ func getFileEnding(path string) string {
 	return parts[len(parts)-1]
 }
 
-func parseGPX(data []byte, trackID int) (orb.LineString, error) {
+// parseGPX offers each route and each track segment with at least two points
+// as a track. If joinSegments is set, the segments of a track are joined into
+// one with gaps instead. Waypoints are not read, since neither chapters nor
+// via-points are supported.
+func parseGPX(data []byte, joinSegments bool) ([]track, error) {
 	gpxFile, err := gpx.ParseBytes(data)
 	if err != nil {
 		return nil, err
 	}
 
-	tracks := make([]orb.LineString, 0, len(gpxFile.Tracks))
-	trackDesc := make([]string, 0, len(gpxFile.Tracks))
-	for _, track := range gpxFile.Tracks {
-		ls := orb.LineString{}
-		for _, segment := range track.Segments {
-			for _, point := range segment.Points {
-				ls = append(ls, orb.Point{point.Longitude, point.Latitude})
+	tracks := []track{}
+	for i, gpxTrack := range gpxFile.Tracks {
+		name := gpxTrack.Name
+		if name == "" {
+			name = fmt.Sprintf("Track #%d", i)
+		}
+
+		if joinSegments {
+			t := track{name: name}
+			for _, segment := range gpxTrack.Segments {
+				if len(segment.Points) < 2 {
+					continue
+				}
+				if len(t.line) > 0 {
+					t.gaps = append(t.gaps, len(t.line))
+				}
+				addGPXPoints(&t, segment.Points)
 			}
+			tracks = appendTrack(tracks, t)
+			continue
+		}
+
+		for j, segment := range gpxTrack.Segments {
+			t := track{name: name}
+			if len(gpxTrack.Segments) > 1 {
+				t.name = fmt.Sprintf("%s, segment #%d", name, j)
+			}
+			addGPXPoints(&t, segment.Points)
+			tracks = appendTrack(tracks, t)
 		}
-		trackDesc = append(trackDesc, track.Name)
-		tracks = append(tracks, ls)
 	}
 
-	return chooseTrack(tracks, trackDesc, trackID)
+	for i, route := range gpxFile.Routes {
+		name := route.Name
+		if name == "" {
+			name = fmt.Sprintf("Route #%d", i)
+		}
+		t := track{name: name}
+		addGPXPoints(&t, route.Points)
+		tracks = appendTrack(tracks, t)
+	}
+	return tracks, nil
 }
 
-func parseGeoJSON(data []byte, trackID int) (orb.LineString, error) {
-	// TODO: what if the toplevel is not a FeatureCollection?
-	fc, err := geojson.UnmarshalFeatureCollection(data)
-	if err != nil {
-		return nil, err
+func addGPXPoints(t *track, points []gpx.GPXPoint) {
+	for _, point := range points {
+		t.line = append(t.line, orb.Point{point.Longitude, point.Latitude})
 	}
+}
 
-	tracks := []orb.LineString{}
-	trackDesc := []string{}
-	for _, feat := range fc.Features {
-		g := feat.Geometry
-		switch g.GeoJSONType() {
-		case "LineString":
-			trackDesc = append(trackDesc, "LineString")
-			tracks = append(tracks, g.(orb.LineString))
+// parseGeoJSON reads FeatureCollections, Features, Geometries and
+// GeometryCollections, as well as several of them in newline-delimited
+// GeoJSON. LineStrings and each part of a MultiLineString with at least two
+// points become tracks.
+func parseGeoJSON(data []byte) ([]track, error) {
+	tracks := []track{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	for {
+		var raw json.RawMessage
+		err := dec.Decode(&raw)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
 
-		case "MultiLineString":
-			for i, l := range g.(orb.MultiLineString) {
-				trackDesc = append(trackDesc, fmt.Sprintf("MultiLineString #%d", i))
-				tracks = append(tracks, l)
+		var object struct {
+			Type string `json:"type"`
+		}
+		if err := json.Unmarshal(raw, &object); err != nil {
+			return nil, err
+		}
+
+		switch object.Type {
+		case "FeatureCollection":
+			fc, err := geojson.UnmarshalFeatureCollection(raw)
+			if err != nil {
+				return nil, err
+			}
+			for _, feat := range fc.Features {
+				tracks = addGeoJSONFeature(tracks, feat)
+			}
+
+		case "Feature":
+			feat, err := geojson.UnmarshalFeature(raw)
+			if err != nil {
+				return nil, err
 			}
+			tracks = addGeoJSONFeature(tracks, feat)
 
 		default:
-			log.Printf("Unknown GeoJSON type, ignoring: %s\n", g.GeoJSONType())
+			g, err := geojson.UnmarshalGeometry(raw)
+			if err != nil {
+				return nil, err
+			}
+			tracks = addGeoJSONGeometry(tracks, g.Geometry(), g.Geometry().GeoJSONType(), nil)
+		}
+	}
+
+	return tracks, nil
+}
+
+// addGeoJSONFeature adds the feature's tracks. They're named after its name
+// or id property, or its geometry's type otherwise.
+func addGeoJSONFeature(tracks []track, feat *geojson.Feature) []track {
+	if feat.Geometry == nil {
+		return tracks
+	}
+
+	props := make(map[string]string, len(feat.Properties)+1)
+	for key, value := range feat.Properties {
+		switch value.(type) {
+		case string, float64, bool:
+			props[key] = fmt.Sprint(value)
+		}
+	}
+	if _, ok := props["id"]; !ok && feat.ID != nil {
+		props["id"] = fmt.Sprint(feat.ID)
+	}
+
+	name := props["name"]
+	if name == "" {
+		name = props["id"]
+	}
+
+	// points mark places along the route, e.g. in exports of route
+	// planners, but aren't routes themselves
+	if _, ok := feat.Geometry.(orb.Point); ok {
+		return tracks
+	}
+
+	if name == "" {
+		name = feat.Geometry.GeoJSONType()
+	}
+	return addGeoJSONGeometry(tracks, feat.Geometry, name, props)
+}
+
+func addGeoJSONGeometry(tracks []track, g orb.Geometry, name string, props map[string]string) []track {
+	switch g := g.(type) {
+	case orb.LineString:
+		t := track{name: name, line: g, properties: props}
+		tracks = appendTrack(tracks, t)
+
+	case orb.MultiLineString:
+		for i, l := range g {
+			t := track{name: fmt.Sprintf("%s #%d", name, i), line: l, properties: props}
+			tracks = appendTrack(tracks, t)
+		}
+
+	case orb.Collection:
+		for i, part := range g {
+			tracks = addGeoJSONGeometry(tracks, part, fmt.Sprintf("%s #%d", name, i), props)
+		}
+
+	default:
+		log.Printf("Unknown GeoJSON type, ignoring: %s\n", g.GeoJSONType())
+	}
+	return tracks
+}
+
+// parseKML reads the LineStrings and gx:Tracks of all placemarks, including
+// those within a MultiGeometry or gx:MultiTrack. Each becomes its own track
+// named after its placemark.
+func parseKML(data []byte) ([]track, error) {
+	dec := xml.NewDecoder(bytes.NewReader(data))
+
+	tracks := []track{}
+	placemarks := 0
+	var inPlacemark bool
+	var name string
+	var lines []orb.LineString
+	var gxTrack orb.LineString
+	// local names of the open elements, since KML and gx share some
+	var open []string
+	var text strings.Builder
+
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			open = append(open, t.Name.Local)
+			text.Reset()
+			switch t.Name.Local {
+			case "Placemark":
+				inPlacemark = true
+				placemarks++
+				name = ""
+				lines = nil
+			case "Track":
+				gxTrack = orb.LineString{}
+			}
+
+		case xml.CharData:
+			text.Write(t)
+
+		case xml.EndElement:
+			parent := ""
+			if len(open) >= 2 {
+				parent = open[len(open)-2]
+			}
+			open = open[:len(open)-1]
+			if !inPlacemark {
+				continue
+			}
+
+			switch t.Name.Local {
+			case "name":
+				if parent == "Placemark" {
+					name = strings.TrimSpace(text.String())
+				}
+			case "coordinates":
+				// polygons have coordinates too, but aren't routes
+				if parent == "LineString" {
+					ls, err := parseKMLCoordinates(text.String())
+					if err != nil {
+						return nil, err
+					}
+					lines = append(lines, ls)
+				}
+			case "coord":
+				if parent == "Track" {
+					p, err := parseKMLPoint(strings.Fields(text.String()))
+					if err != nil {
+						return nil, err
+					}
+					gxTrack = append(gxTrack, p)
+				}
+			case "Track":
+				lines = append(lines, gxTrack)
+			case "Placemark":
+				inPlacemark = false
+				if name == "" {
+					name = fmt.Sprintf("Placemark #%d", placemarks-1)
+				}
+				for i, ls := range lines {
+					desc := name
+					if len(lines) > 1 {
+						desc = fmt.Sprintf("%s #%d", name, i)
+					}
+					tracks = appendTrack(tracks, track{name: desc, line: ls})
+				}
+			}
+		}
+	}
+
+	return tracks, nil
+}
+
+// parseKMLCoordinates reads the content of a <coordinates> element, i.e.
+// whitespace separated tuples of lon,lat[,alt]
+func parseKMLCoordinates(s string) (orb.LineString, error) {
+	ls := orb.LineString{}
+	for _, tuple := range strings.Fields(s) {
+		p, err := parseKMLPoint(strings.Split(tuple, ","))
+		if err != nil {
+			return nil, err
+		}
+		ls = append(ls, p)
+	}
+	return ls, nil
+}
+
+// parseKMLPoint reads lon, lat and optionally altitude, which is ignored
+func parseKMLPoint(values []string) (orb.Point, error) {
+	if len(values) < 2 {
+		return orb.Point{}, fmt.Errorf("invalid KML coordinate %q", strings.Join(values, ","))
+	}
+	lon, err := strconv.ParseFloat(values[0], 64)
+	if err != nil {
+		return orb.Point{}, fmt.Errorf("invalid KML longitude %q", values[0])
+	}
+	lat, err := strconv.ParseFloat(values[1], 64)
+	if err != nil {
+		return orb.Point{}, fmt.Errorf("invalid KML latitude %q", values[1])
+	}
+	return orb.Point{lon, lat}, nil
+}
+
+// parseKMZ reads the main KML file of the zipped KMZ, which is doc.kml or
+// otherwise the first KML file in the archive's root
+func parseKMZ(data []byte) ([]track, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+
+	var doc *zip.File
+	for _, f := range zr.File {
+		if f.Name == "doc.kml" {
+			doc = f
+			break
+		}
+		if doc == nil && !strings.Contains(f.Name, "/") && strings.ToLower(path.Ext(f.Name)) == ".kml" {
+			doc = f
 		}
 	}
+	if doc == nil {
+		return nil, errors.New("The given KMZ file does not contain a KML file")
+	}
+
+	rc, err := doc.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	kml, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+	return parseKML(kml)
+}
+
+type tcxTrackpoint struct {
+	Latitude  *float64 `xml:"Position>LatitudeDegrees"`
+	Longitude *float64 `xml:"Position>LongitudeDegrees"`
+}
 
-	return chooseTrack(tracks, trackDesc, trackID)
+type tcxFile struct {
+	Activities []struct {
+		Sport       string          `xml:"Sport,attr"`
+		ID          string          `xml:"Id"`
+		Trackpoints []tcxTrackpoint `xml:"Lap>Track>Trackpoint"`
+	} `xml:"Activities>Activity"`
+	Courses []struct {
+		Name        string          `xml:"Name"`
+		Trackpoints []tcxTrackpoint `xml:"Track>Trackpoint"`
+	} `xml:"Courses>Course"`
 }
 
-func chooseTrack(tracks []orb.LineString, trackDesc []string, trackID int) (orb.LineString, error) {
-	if len(tracks) == 1 {
-		return tracks[0], nil
+// parseTCX reads the activities and courses of a Garmin Training Center
+// file. All laps of an activity become one track. Trackpoints without a
+// position are skipped.
+func parseTCX(data []byte) ([]track, error) {
+	var tcx tcxFile
+	if err := xml.Unmarshal(data, &tcx); err != nil {
+		return nil, err
 	}
 
+	tracks := []track{}
+	for _, activity := range tcx.Activities {
+		name := strings.TrimSpace(activity.Sport + " " + activity.ID)
+		tracks = appendTrack(tracks, tcxTrack(name, activity.Trackpoints))
+	}
+	for _, course := range tcx.Courses {
+		tracks = appendTrack(tracks, tcxTrack(course.Name, course.Trackpoints))
+	}
+	return tracks, nil
+}
+
+func tcxTrack(name string, trackpoints []tcxTrackpoint) track {
+	t := track{name: name}
+	for _, tp := range trackpoints {
+		if tp.Latitude == nil || tp.Longitude == nil {
+			continue
+		}
+		t.line = append(t.line, orb.Point{*tp.Longitude, *tp.Latitude})
+	}
+	return t
+}
+
+// filterTracks keeps the tracks whose property matches, given as key=value
+func filterTracks(tracks []track, where string) ([]track, error) {
+	parts := strings.SplitN(where, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return nil, fmt.Errorf("Expected the track filter as key=value, got %q", where)
+	}
+	key, value := parts[0], parts[1]
+
+	matching := []track{}
+	for _, t := range tracks {
+		if v, ok := t.property(key); ok && v == value {
+			matching = append(matching, t)
+		}
+	}
+	if len(matching) == 0 {
+		return nil, fmt.Errorf("None of the %d tracks in the given file has %s", len(tracks), where)
+	}
+	return matching, nil
+}
+
+// chooseTrack picks the track given by opts.selector, or merges all of them.
+// The selector is tried as exact name first, so that tracks named "all" or
+// "2" can be chosen, then as "all", index and glob pattern. The error lists
+// the tracks if the choice is missing or ambiguous.
+func chooseTrack(tracks []track, opts trackOptions) (track, error) {
 	if len(tracks) == 0 {
-		return nil, errors.New("The given file does not contain any tracks")
+		return track{}, errors.New("The given file does not contain any tracks")
+	}
+
+	named := []int{}
+	for idx, t := range tracks {
+		if opts.selector != "" && t.name == opts.selector {
+			named = append(named, idx)
+		}
+	}
+	switch len(named) {
+	case 0:
+	case 1:
+		return tracks[named[0]], nil
+	default:
+		return track{}, trackChooserError(fmt.Sprintf("Several tracks are named %q", opts.selector), tracks, named...)
+	}
+
+	if opts.selector == "all" {
+		return mergeTracks(tracks, opts.mergeOrder)
+	}
+
+	idx, err := strconv.Atoi(opts.selector)
+	isIndex := err == nil
+	// negative indices used to mean asking, too
+	if opts.selector == "" || isIndex && idx < 0 {
+		if len(tracks) == 1 {
+			return tracks[0], nil
+		}
+		return track{}, trackChooserError("The file you specified contains multiple tracks", tracks)
+	}
+
+	if isIndex {
+		if len(tracks) == 1 {
+			return tracks[0], nil
+		}
+		if idx >= len(tracks) {
+			errMsg := fmt.Sprintf("The given file only contains %d tracks, cannot select track %d", len(tracks), idx)
+			return track{}, errors.New(errMsg)
+		}
+		return tracks[idx], nil
+	}
+
+	matching := []int{}
+	for idx, t := range tracks {
+		ok, err := path.Match(opts.selector, t.name)
+		if err != nil {
+			return track{}, fmt.Errorf("Invalid track name pattern %q: %v", opts.selector, err)
+		}
+		if ok {
+			matching = append(matching, idx)
+		}
+	}
+	switch len(matching) {
+	case 0:
+		return track{}, trackChooserError(fmt.Sprintf("No track is named %q", opts.selector), tracks)
+	case 1:
+		return tracks[matching[0]], nil
+	default:
+		return track{}, trackChooserError(fmt.Sprintf("Several tracks match %q", opts.selector), tracks, matching...)
+	}
+}
+
+// trackChooserError lists the tracks with the given indices, or all of them
+func trackChooserError(reason string, tracks []track, only ...int) error {
+	if len(only) == 0 {
+		for idx := range tracks {
+			only = append(only, idx)
+		}
+	}
+	chooser := "\n" + reason + ". Please choose which should be used:\n"
+	for _, idx := range only {
+		t := tracks[idx]
+		chooser += fmt.Sprintf("  %2d: %s (%d points, %.1f km)\n", idx, t.name, len(t.line), t.lengthKm())
 	}
+	chooser += fmt.Sprintf("\ne.g. %s --track %d, --track %q or --track all", strings.Join(os.Args, " "), only[0], tracks[only[0]].name)
+	return errors.New(chooser)
+}
+
+func (t track) lengthKm() float64 {
+	return geo.Length(t.line) / 1000
+}
 
-	if trackID >= len(tracks) {
-		errMsg := fmt.Sprintf("The given file only contains %d tracks, cannot select track %d", len(tracks), trackID)
-		return nil, errors.New(errMsg)
+// mergeOrders are the ways in which mergeTracks can order the tracks
+var mergeOrders = []string{"file", "nearest"}
+
+// mergeTracks concatenates the tracks into one with gaps in between. They are
+// either kept in file order, or each is followed by the one with the nearest
+// endpoint, reversed if needed.
+func mergeTracks(tracks []track, order string) (track, error) {
+	switch order {
+	case "file", "":
+	case "nearest":
+		tracks = nearestEndpointOrder(tracks)
+	default:
+		return track{}, fmt.Errorf("Unknown merge order %q, expected one of: %s", order, strings.Join(mergeOrders, ", "))
 	}
 
-	if trackID >= 0 {
-		return tracks[trackID], nil
+	merged := track{name: fmt.Sprintf("%d tracks", len(tracks))}
+	for _, t := range tracks {
+		if len(merged.line) > 0 {
+			merged.gaps = append(merged.gaps, len(merged.line))
+		}
+		for _, gap := range t.gaps {
+			merged.gaps = append(merged.gaps, len(merged.line)+gap)
+		}
+		merged.line = append(merged.line, t.line...)
 	}
+	return merged, nil
+}
 
-	chooser := "\nThe file you specified contains multiple tracks. Please choose which should be used:\n"
-	for idx, track := range tracks {
-		desc := trackDesc[idx] + fmt.Sprintf(" (length: %d)", len(track))
-		chooser += fmt.Sprintf("  %2d: %s\n", idx, desc)
+// nearestEndpointOrder starts with the first track and then greedily picks
+// the track whose start or end is closest to the current end
+func nearestEndpointOrder(tracks []track) []track {
+	remaining := append([]track{}, tracks[1:]...)
+	ordered := []track{tracks[0]}
+	for len(remaining) > 0 {
+		last := ordered[len(ordered)-1]
+		end := last.line[len(last.line)-1]
+
+		best, reverse := 0, false
+		bestDist := math.Inf(1)
+		for i, t := range remaining {
+			if d := geo.Distance(end, t.line[0]); d < bestDist {
+				best, reverse, bestDist = i, false, d
+			}
+			if d := geo.Distance(end, t.line[len(t.line)-1]); d < bestDist {
+				best, reverse, bestDist = i, true, d
+			}
+		}
+
+		next := remaining[best]
+		if reverse {
+			next = next.reversed()
+		}
+		ordered = append(ordered, next)
+		remaining = append(remaining[:best], remaining[best+1:]...)
+	}
+	return ordered
+}
+
+// reversed returns a copy of the track running the other way
+func (t track) reversed() track {
+	r := t
+	n := len(t.line)
+	r.line = make(orb.LineString, n)
+	for i := 0; i < n; i++ {
+		r.line[i] = t.line[n-1-i]
+	}
+	r.gaps = make([]int, len(t.gaps))
+	for i, gap := range t.gaps {
+		r.gaps[len(t.gaps)-1-i] = n - gap
 	}
-	chooser += fmt.Sprintf("\ne.g. %s --track 0", strings.Join(os.Args, " "))
-	return nil, errors.New(chooser)
+	return r
 }
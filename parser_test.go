@@ -0,0 +1,336 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/paulmach/orb"
+)
+
+func trackNames(tracks []track) []string {
+	names := []string{}
+	for _, t := range tracks {
+		names = append(names, t.name)
+	}
+	return names
+}
+
+func TestTracksNeedTwoPoints(t *testing.T) {
+	tests := []struct {
+		file string
+		opts trackOptions
+		want []string
+	}{
+		{"short.kml", trackOptions{}, []string{"line"}},
+		// the routes come after the tracks
+		{"short.gpx", trackOptions{}, []string{"track, segment #1", "route"}},
+		{"short.gpx", trackOptions{joinSegments: true}, []string{"track", "route"}},
+		{"short.geojson", trackOptions{}, []string{"line", "multi #1"}},
+		// the activity's second trackpoint has no position
+		{"short.tcx", trackOptions{}, []string{"course"}},
+	}
+	for _, tt := range tests {
+		tracks, err := tracksFromFile(filepath.Join("testdata", tt.file), tt.opts)
+		if err != nil {
+			t.Errorf("Failed to read %s: %v", tt.file, err)
+			continue
+		}
+		if got := trackNames(tracks); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s has tracks %q, expected %q", tt.file, got, tt.want)
+		}
+		for _, tr := range tracks {
+			if len(tr.line) < 2 {
+				t.Errorf("%s: track %q has %d points", tt.file, tr.name, len(tr.line))
+			}
+		}
+	}
+}
+
+func TestParseKML(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "tracks.kml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracks, err := parseKML(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := orb.LineString{{13.3777, 52.5165}, {13.3839, 52.5166}}
+	want := []track{
+		// altitudes are dropped
+		{name: "line", line: first},
+		// the polygon is no route
+		{name: "multi #0", line: first},
+		{name: "multi #1", line: orb.LineString{{13.3839, 52.5166}, {13.3902, 52.5167}}},
+		{name: "Placemark #2", line: first},
+	}
+	if !reflect.DeepEqual(tracks, want) {
+		t.Errorf("Got tracks\n%+v\nexpected\n%+v", tracks, want)
+	}
+}
+
+func TestParseKMLErrors(t *testing.T) {
+	tests := map[string]string{
+		"coordinate": "<kml><Placemark><LineString><coordinates>13.3777</coordinates></LineString></Placemark></kml>",
+		"longitude":  "<kml><Placemark><LineString><coordinates>east,52.5</coordinates></LineString></Placemark></kml>",
+		"gx:coord":   "<kml><Placemark><Track><coord>13.3777 north</coord></Track></Placemark></kml>",
+		"truncated":  "<kml><Placemark><LineString><coordinates>13.3777,52.5165",
+	}
+	for name, kml := range tests {
+		if _, err := parseKML([]byte(kml)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+// kmz zips the files, given as pairs of name and content
+func kmz(t *testing.T, files ...string) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for i := 0; i < len(files); i += 2 {
+		w, err := zw.Create(files[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(files[i+1]))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestParseKMZ(t *testing.T) {
+	kml := func(name string) string {
+		return "<kml><Placemark><name>" + name + "</name><LineString><coordinates>13.3777,52.5165 13.3839,52.5166</coordinates></LineString></Placemark></kml>"
+	}
+
+	tests := []struct {
+		name string
+		kmz  []byte
+		want []string
+	}{
+		{"doc.kml", kmz(t, "a.kml", kml("a"), "doc.kml", kml("doc")), []string{"doc"}},
+		{"first in root", kmz(t, "files/nested.kml", kml("nested"), "b.KML", kml("b"), "c.kml", kml("c")), []string{"b"}},
+		{"no KML", kmz(t, "files/nested.kml", kml("nested"), "image.png", ""), nil},
+		{"not zipped", []byte(kml("plain")), nil},
+	}
+	for _, tt := range tests {
+		tracks, err := parseKMZ(tt.kmz)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("%s: expected an error", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got := trackNames(tracks); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got tracks %q, expected %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseTCX(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "tracks.tcx"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracks, err := parseTCX(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []track{
+		// the laps and their tracks are joined, the trackpoint without a
+		// position is skipped
+		{name: "Biking 2020-06-01T10:00:00Z", line: orb.LineString{{13.3777, 52.5165}, {13.3839, 52.5166}, {13.3902, 52.5167}}},
+		{name: "course", line: orb.LineString{{13.3902, 52.5167}, {13.3777, 52.5165}}},
+	}
+	if !reflect.DeepEqual(tracks, want) {
+		t.Errorf("Got tracks\n%+v\nexpected\n%+v", tracks, want)
+	}
+
+	if _, err := parseTCX(data[:len(data)/2]); err == nil {
+		t.Errorf("Expected an error for a truncated file")
+	}
+}
+
+func TestParseGPX(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "tracks.gpx"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := orb.LineString{{13.3777, 52.5165}, {13.3839, 52.5166}}
+	last := orb.LineString{{13.3902, 52.5167}, {13.3965, 52.5168}}
+	route := track{name: "Route #0", line: orb.LineString{{13.3902, 52.5167}, {13.3777, 52.5165}}}
+	unnamed := track{name: "Track #1", line: first}
+
+	tests := []struct {
+		name         string
+		joinSegments bool
+		want         []track
+	}{
+		// the segment with a single point is skipped, but still counted
+		{"segments", false, []track{
+			{name: "Unter den Linden, segment #0", line: first},
+			{name: "Unter den Linden, segment #2", line: last},
+			unnamed,
+			route,
+		}},
+		{"joined", true, []track{
+			{name: "Unter den Linden", line: append(append(orb.LineString{}, first...), last...), gaps: []int{2}},
+			unnamed,
+			route,
+		}},
+	}
+	for _, tt := range tests {
+		tracks, err := parseGPX(data, tt.joinSegments)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(tracks, tt.want) {
+			t.Errorf("%s: got tracks\n%+v\nexpected\n%+v", tt.name, tracks, tt.want)
+		}
+	}
+
+	if _, err := parseGPX(data[:len(data)/2], false); err == nil {
+		t.Errorf("Expected an error for a truncated file")
+	}
+}
+
+func TestParseGeoJSON(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "tracks.geojson"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracks, err := parseGeoJSON(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := orb.LineString{{13.3777, 52.5165}, {13.3839, 52.5166}}
+	b := orb.LineString{{13.3839, 52.5166}, {13.3902, 52.5167}}
+	want := []track{
+		{name: "north", line: a, properties: map[string]string{"name": "north", "kind": "bike"}},
+		// lists aren't properties to filter by
+		{name: "7", line: b, properties: map[string]string{"id": "7", "kind": "foot", "lanes": "2"}},
+		// the point and the feature without geometry are no tracks
+		{name: "MultiLineString #0", line: a, properties: map[string]string{"kind": "bike"}},
+		{name: "MultiLineString #1", line: b, properties: map[string]string{"kind": "bike"}},
+		{name: "LineString", line: orb.LineString{{13.3902, 52.5167}, {13.3777, 52.5165}}},
+		{name: "GeometryCollection #1", line: a},
+	}
+	if !reflect.DeepEqual(tracks, want) {
+		t.Errorf("Got tracks\n%+v\nexpected\n%+v", tracks, want)
+	}
+
+	if _, err := parseGeoJSON(data[:len(data)/2]); err == nil {
+		t.Errorf("Expected an error for a truncated file")
+	}
+}
+
+func TestTrackWhere(t *testing.T) {
+	file := filepath.Join("testdata", "tracks.geojson")
+	tests := []struct {
+		where string
+		want  []string
+	}{
+		{"kind=bike", []string{"north", "MultiLineString #0", "MultiLineString #1"}},
+		{"lanes=2", []string{"7"}},
+		{"id=7", []string{"7"}},
+		// the name is known even if it's not a property
+		{"name=LineString", []string{"LineString"}},
+		{"kind=car", nil},
+		{"kind", nil},
+		{"=bike", nil},
+	}
+	for _, tt := range tests {
+		tracks, err := tracksFromFile(file, trackOptions{where: tt.where})
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("%s: expected an error, got tracks %q", tt.where, trackNames(tracks))
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.where, err)
+			continue
+		}
+		if got := trackNames(tracks); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got tracks %q, expected %q", tt.where, got, tt.want)
+		}
+	}
+}
+
+func TestChooseTrack(t *testing.T) {
+	p := func(lon float64) orb.Point { return orb.Point{lon, 52.5} }
+	north := track{name: "north", line: orb.LineString{p(13.37), p(13.38)}}
+	east := track{name: "east", line: orb.LineString{p(13.39), p(13.40)}}
+	// runs back towards north's end, with a gap
+	two := track{name: "2", line: orb.LineString{p(13.39), p(13.385), p(13.38)}, gaps: []int{1}}
+	tracks := []track{north, east, two}
+
+	fileOrder := track{
+		name: "3 tracks",
+		line: orb.LineString{p(13.37), p(13.38), p(13.39), p(13.40), p(13.39), p(13.385), p(13.38)},
+		gaps: []int{2, 4, 5},
+	}
+	// two is reversed to follow north, and its gap with it
+	nearestOrder := track{
+		name: "3 tracks",
+		line: orb.LineString{p(13.37), p(13.38), p(13.38), p(13.385), p(13.39), p(13.39), p(13.40)},
+		gaps: []int{2, 4, 5},
+	}
+
+	tests := []struct {
+		name   string
+		tracks []track
+		opts   trackOptions
+		want   *track
+	}{
+		{"name", tracks, trackOptions{selector: "north"}, &north},
+		{"name before index", tracks, trackOptions{selector: "2"}, &two},
+		{"index", tracks, trackOptions{selector: "1"}, &east},
+		{"glob", tracks, trackOptions{selector: "n*"}, &north},
+		{"all", tracks, trackOptions{selector: "all"}, &fileOrder},
+		{"all in file order", tracks, trackOptions{selector: "all", mergeOrder: "file"}, &fileOrder},
+		{"all in nearest order", tracks, trackOptions{selector: "all", mergeOrder: "nearest"}, &nearestOrder},
+		{"only track", []track{east}, trackOptions{}, &east},
+		{"only track by index", []track{east}, trackOptions{selector: "3"}, &east},
+		{"ask", tracks, trackOptions{}, nil},
+		{"negative index", tracks, trackOptions{selector: "-1"}, nil},
+		{"index out of range", tracks, trackOptions{selector: "5"}, nil},
+		{"ambiguous glob", tracks, trackOptions{selector: "*"}, nil},
+		{"invalid glob", tracks, trackOptions{selector: "["}, nil},
+		{"unknown name", tracks, trackOptions{selector: "south"}, nil},
+		{"ambiguous name", []track{north, north}, trackOptions{selector: "north"}, nil},
+		{"unknown merge order", tracks, trackOptions{selector: "all", mergeOrder: "random"}, nil},
+		{"no tracks", nil, trackOptions{}, nil},
+	}
+	for _, tt := range tests {
+		got, err := chooseTrack(tt.tracks, tt.opts)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("%s: expected an error, got track %q", tt.name, got.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, *tt.want) {
+			t.Errorf("%s: got track\n%+v\nexpected\n%+v", tt.name, got, *tt.want)
+		}
+	}
+}
@@ -1,9 +1,17 @@
 package main
 
 import (
+	"context"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
 
+	"github.com/breunigs/photoepics/bolt"
 	"github.com/breunigs/photoepics/browser"
+	"github.com/breunigs/photoepics/dgraph"
+	"github.com/breunigs/photoepics/memory"
+	"github.com/breunigs/photoepics/store"
 	"github.com/spf13/cobra"
 )
 
@@ -11,16 +19,89 @@ var rootCmd = &cobra.Command{
 	Use:   "photoepics",
 	Short: "convert GPX into Mapillary photo sequences",
 	Long:  "Photoepics takes a GeoJSON file as input and tries to find matching sequences of photos from Mapillary.",
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		applyHostLimits()
+		cleanupCache()
+	},
 }
 
+const defaultBoltPath = "photoepics.db"
+
+var storeBackend string
+var storePath string
+var hostLimits []string
+
 func main() {
+	rootCmd.PersistentFlags().StringVar(&storeBackend, "store", "dgraph", "where to keep photos and edges. One of: dgraph, memory, bolt")
+	rootCmd.PersistentFlags().StringVar(&storePath, "store-path", "", "file for the memory and bolt stores. The memory store reads it on start and saves to it on exit, without it nothing is kept between invocations. The bolt store defaults to "+defaultBoltPath+".")
+	cacheFlags(rootCmd)
+	rateLimitFlags(rootCmd)
 	rootCmd.AddCommand(cmdPurge())
 	rootCmd.AddCommand(cmdLoad())
 	rootCmd.AddCommand(cmdQuery())
-	rootCmd.Execute()
+	rootCmd.AddCommand(cmdCoverage())
+	rootCmd.AddCommand(cmdFakeMapillary())
+	rootCmd.AddCommand(cmdCache())
+	rootCmd.AddCommand(cmdTracks())
+	rootCmd.ExecuteContext(interruptibleContext())
+}
+
+// interruptibleContext is cancelled on the first Ctrl-C, so that commands stop
+// and write what they have, as far as the store allows. Another Ctrl-C quits
+// immediately.
+func interruptibleContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		signal.Stop(sigs)
+		log.Println("Interrupted, stopping. Press Ctrl-C again to quit immediately.")
+		cancel()
+	}()
+	return ctx
+}
+
+func rateLimitFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().Float64Var(&browser.DefaultLimits.Rate, "rate", browser.DefaultLimits.Rate, "requests per second to each host. 0 disables the limit.")
+	cmd.PersistentFlags().IntVar(&browser.DefaultLimits.Burst, "burst", browser.DefaultLimits.Burst, "how many requests may be sent to a host at once after a pause")
+	cmd.PersistentFlags().IntVar(&browser.DefaultLimits.MaxConns, "max-connections", browser.DefaultLimits.MaxConns, "how many requests to a host may be in flight at the same time. 0 disables the limit.")
+	cmd.PersistentFlags().StringArrayVar(&hostLimits, "host-limit", nil, "limits for a single host as host=rate/burst/connections, e.g. graph.mapillary.com=10/20/8. Can be given multiple times.")
+}
+
+func applyHostLimits() {
+	if browser.DefaultLimits.Burst < 1 {
+		log.Fatalf("--burst must be at least 1, got %d", browser.DefaultLimits.Burst)
+	}
+	for _, l := range hostLimits {
+		host, limits, err := browser.ParseHostLimits(l)
+		if err != nil {
+			log.Fatalf("Invalid --host-limit: %v", err)
+		}
+		browser.SetHostLimits(host, limits)
+	}
+}
+
+// openStore opens the configured backend. Dgraph cancels its queries and
+// mutations once ctx is done, the other stores finish what they are doing.
+func openStore(ctx context.Context) store.Store {
+	switch storeBackend {
+	case "dgraph":
+		return dgraph.NewStore(ctx)
+	case "memory":
+		return memory.New(storePath)
+	case "bolt":
+		if storePath == "" {
+			return bolt.New(defaultBoltPath)
+		}
+		return bolt.New(storePath)
+	default:
+		log.Fatalf("Unknown store %q, expected one of: dgraph, memory, bolt", storeBackend)
+		return nil
+	}
 }
 
 func doStuff() {
-	log.Println(browser.Get("https://a.mapillary.com/v3/images?client_id="))
+	log.Println(browser.Get(context.Background(), "https://a.mapillary.com/v3/images?client_id="))
 
 }
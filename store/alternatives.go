@@ -0,0 +1,131 @@
+package store
+
+import (
+	"math"
+	"sort"
+)
+
+// how much more expensive edges into a photo get for each found path that
+// already uses it
+const alternativePenalty = 0.5
+
+// how many searches to run per requested path before giving up on finding
+// enough different ones
+const alternativeAttempts = 5
+
+// UidPath is like Path, but only contains the photos' Uids
+type UidPath struct {
+	Uids []string
+	Cost float64
+}
+
+// AlternativePaths finds up to n paths between two Uids which share at most
+// maxOverlap (0 to 1) of their photos with each other, not counting the
+// start and end. After each search the
+// edges into photos of the found path become more expensive, so the next one
+// tends to use different photos. The returned costs use the original weights
+// and the paths are ordered by them.
+func AlternativePaths(from, to string, neighbors func(uid string) []Edge, n int, maxOverlap float64) []UidPath {
+	used := make(map[string]int)
+	penalized := func(uid string) []Edge {
+		edges := neighbors(uid)
+		out := make([]Edge, len(edges))
+		for i, e := range edges {
+			out[i] = e
+			out[i].Weight *= math.Pow(1+alternativePenalty, float64(used[e.To]))
+		}
+		return out
+	}
+
+	var found []UidPath
+	for attempt := 0; attempt < n*alternativeAttempts && len(found) < n; attempt++ {
+		uids, _ := ShortestPath(from, to, penalized)
+		if uids == nil {
+			break
+		}
+		// every path ends in `to`, so penalizing it wouldn't favor others
+		for _, uid := range between(uids) {
+			used[uid]++
+		}
+
+		if overlapsAny(uids, found, maxOverlap) {
+			continue
+		}
+		found = append(found, UidPath{Uids: uids, Cost: pathCost(uids, neighbors)})
+	}
+
+	sort.SliceStable(found, func(i, j int) bool { return found[i].Cost < found[j].Cost })
+	return found
+}
+
+// DiversePaths keeps the first n candidates which share at most maxOverlap
+// (0 to 1) of their photos with any previously kept one, not counting the
+// start and end.
+func DiversePaths(candidates []UidPath, n int, maxOverlap float64) []UidPath {
+	var kept []UidPath
+	for _, c := range candidates {
+		if len(kept) == n {
+			break
+		}
+		if !overlapsAny(c.Uids, kept, maxOverlap) {
+			kept = append(kept, c)
+		}
+	}
+	return kept
+}
+
+func overlapsAny(uids []string, others []UidPath, maxOverlap float64) bool {
+	for _, other := range others {
+		if overlap(uids, other.Uids) > maxOverlap {
+			return true
+		}
+	}
+	return false
+}
+
+// overlap returns the share of photos in a that are also in b. All paths
+// share their start and end, so only the photos in between are compared.
+func overlap(a, b []string) float64 {
+	a, b = between(a), between(b)
+	if len(a) == 0 {
+		// both go straight from start to end, i.e. are the same path
+		if len(b) == 0 {
+			return 1
+		}
+		return 0
+	}
+
+	inB := make(map[string]bool, len(b))
+	for _, uid := range b {
+		inB[uid] = true
+	}
+
+	shared := 0
+	for _, uid := range a {
+		if inB[uid] {
+			shared++
+		}
+	}
+	return float64(shared) / float64(len(a))
+}
+
+// between drops the first and last photo of the path
+func between(uids []string) []string {
+	if len(uids) <= 2 {
+		return nil
+	}
+	return uids[1 : len(uids)-1]
+}
+
+func pathCost(uids []string, neighbors func(uid string) []Edge) float64 {
+	cost := 0.0
+	for i := 0; i < len(uids)-1; i++ {
+		for _, e := range neighbors(uids[i]) {
+			if e.To == uids[i+1] {
+				cost += e.Weight
+				break
+			}
+		}
+	}
+	return cost
+}
@@ -0,0 +1,95 @@
+package store
+
+import (
+	"reflect"
+	"testing"
+)
+
+// graph returns the neighbors function for the given edges
+func graph(edges ...Edge) func(uid string) []Edge {
+	out := make(map[string][]Edge)
+	for _, e := range edges {
+		out[e.From] = append(out[e.From], e)
+	}
+	return func(uid string) []Edge {
+		return out[uid]
+	}
+}
+
+func TestOverlap(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b []string
+		want float64
+	}{
+		{"same", []string{"s", "a", "b", "t"}, []string{"s", "a", "b", "t"}, 1},
+		{"disjoint", []string{"s", "a", "b", "t"}, []string{"s", "c", "d", "t"}, 0},
+		{"half", []string{"s", "a", "b", "t"}, []string{"s", "a", "c", "d", "t"}, 0.5},
+		{"longer", []string{"s", "a", "c", "d", "t"}, []string{"s", "a", "b", "t"}, 1.0 / 3},
+		{"both direct", []string{"s", "t"}, []string{"s", "t"}, 1},
+		{"one direct", []string{"s", "t"}, []string{"s", "a", "t"}, 0},
+	}
+	for _, tt := range tests {
+		if got := overlap(tt.a, tt.b); got != tt.want {
+			t.Errorf("%s: got overlap %v, expected %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDiversePaths(t *testing.T) {
+	ab := UidPath{Uids: []string{"s", "a", "b", "t"}, Cost: 1}
+	ac := UidPath{Uids: []string{"s", "a", "c", "t"}, Cost: 2}
+	de := UidPath{Uids: []string{"s", "d", "e", "t"}, Cost: 3}
+	candidates := []UidPath{ab, ac, de}
+
+	tests := []struct {
+		name       string
+		n          int
+		maxOverlap float64
+		want       []UidPath
+	}{
+		{"disjoint", 3, 0, []UidPath{ab, de}},
+		{"half", 3, 0.5, []UidPath{ab, ac, de}},
+		{"limit", 2, 0.5, []UidPath{ab, ac}},
+		{"one", 1, 0, []UidPath{ab}},
+	}
+	for _, tt := range tests {
+		if got := DiversePaths(candidates, tt.n, tt.maxOverlap); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, expected %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAlternativePaths(t *testing.T) {
+	// three routes from s to t, and a shortcut from route a onto route b
+	neighbors := graph(
+		Edge{"s", "a", 1}, Edge{"a", "t", 1},
+		Edge{"s", "b", 2}, Edge{"b", "t", 2},
+		Edge{"s", "c", 3}, Edge{"c", "t", 3},
+		Edge{"a", "b", 0.5},
+	)
+	a := UidPath{Uids: []string{"s", "a", "t"}, Cost: 2}
+	b := UidPath{Uids: []string{"s", "b", "t"}, Cost: 4}
+	c := UidPath{Uids: []string{"s", "c", "t"}, Cost: 6}
+
+	tests := []struct {
+		name       string
+		n          int
+		maxOverlap float64
+		want       []UidPath
+	}{
+		{"best", 1, 0, []UidPath{a}},
+		{"disjoint", 3, 0, []UidPath{a, b, c}},
+		{"more than there are", 5, 0, []UidPath{a, b, c}},
+	}
+	for _, tt := range tests {
+		got := AlternativePaths("s", "t", neighbors, tt.n, tt.maxOverlap)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, expected %+v", tt.name, got, tt.want)
+		}
+	}
+
+	if got := AlternativePaths("s", "unknown", neighbors, 3, 0); len(got) != 0 {
+		t.Errorf("Got %+v to an unreachable photo, expected nothing", got)
+	}
+}
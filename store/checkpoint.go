@@ -0,0 +1,50 @@
+package store
+
+import "sync"
+
+// Checkpoint remembers which steps of a load have been completed, so that an
+// aborted load can be resumed. Steps marked as done are only persisted once
+// everything sent to the insert stream before has actually been inserted.
+// For this to work, producers must use unbuffered channels and mark a step
+// only after all of its items have been sent.
+type Checkpoint struct {
+	db      Store
+	session string
+	done    map[string]bool
+
+	mu      sync.Mutex
+	pending []string
+}
+
+func NewCheckpoint(db Store, session string) *Checkpoint {
+	return &Checkpoint{
+		db:      db,
+		session: session,
+		done:    db.DoneSteps(session),
+	}
+}
+
+// Done reports if the step was completed in a previous run
+func (c *Checkpoint) Done(step string) bool {
+	return c.done[step]
+}
+
+func (c *Checkpoint) MarkDone(step string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pending = append(c.pending, step)
+}
+
+func (c *Checkpoint) takePending() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	steps := c.pending
+	c.pending = nil
+	return steps
+}
+
+func (c *Checkpoint) commit(steps []string) {
+	if len(steps) > 0 {
+		c.db.MarkDone(c.session, steps)
+	}
+}
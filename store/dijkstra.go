@@ -0,0 +1,71 @@
+package store
+
+import "container/heap"
+
+// ShortestPath finds the cheapest path between two Uids using Dijkstra's
+// algorithm. neighbors must return all outgoing edges of the given Uid. The
+// returned path includes both ends and is nil if `to` is unreachable.
+func ShortestPath(from, to string, neighbors func(uid string) []Edge) ([]string, float64) {
+	dist := map[string]float64{from: 0}
+	prev := map[string]string{}
+	done := map[string]bool{}
+
+	queue := &priorityQueue{{uid: from, cost: 0}}
+	for queue.Len() > 0 {
+		cur := heap.Pop(queue).(queueItem)
+		if done[cur.uid] {
+			continue
+		}
+		done[cur.uid] = true
+
+		if cur.uid == to {
+			path := []string{to}
+			for uid := to; uid != from; {
+				uid = prev[uid]
+				path = append(path, uid)
+			}
+			reverse(path)
+			return path, cur.cost
+		}
+
+		for _, e := range neighbors(cur.uid) {
+			if done[e.To] {
+				continue
+			}
+			cost := cur.cost + e.Weight
+			if known, ok := dist[e.To]; ok && known <= cost {
+				continue
+			}
+			dist[e.To] = cost
+			prev[e.To] = cur.uid
+			heap.Push(queue, queueItem{uid: e.To, cost: cost})
+		}
+	}
+
+	return nil, 0
+}
+
+func reverse(s []string) {
+	for i, j := 0, len(s)-1; i < j; i, j = i+1, j-1 {
+		s[i], s[j] = s[j], s[i]
+	}
+}
+
+type queueItem struct {
+	uid  string
+	cost float64
+}
+
+type priorityQueue []queueItem
+
+func (pq priorityQueue) Len() int            { return len(pq) }
+func (pq priorityQueue) Less(i, j int) bool  { return pq[i].cost < pq[j].cost }
+func (pq priorityQueue) Swap(i, j int)       { pq[i], pq[j] = pq[j], pq[i] }
+func (pq *priorityQueue) Push(x interface{}) { *pq = append(*pq, x.(queueItem)) }
+func (pq *priorityQueue) Pop() interface{} {
+	old := *pq
+	n := len(old)
+	item := old[n-1]
+	*pq = old[:n-1]
+	return item
+}
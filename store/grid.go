@@ -0,0 +1,38 @@
+package store
+
+import (
+	"math"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/maptile"
+)
+
+// zoom level of the tiles used to bucket photos for spatial lookups. At z17
+// a tile is about 300m wide at the equator and gets narrower towards the poles.
+const gridZoom = 17
+
+// rough approximation, good enough to find the tiles to look at
+const metersPerDegree = 111320
+
+// GridCell returns the tile a photo at the given location belongs to.
+func GridCell(pt orb.Point) maptile.Tile {
+	return maptile.At(pt, gridZoom)
+}
+
+// GridCellsAround returns all tiles which might contain points within radius
+// meters of pt. Callers still need to filter by the exact distance.
+func GridCellsAround(pt orb.Point, radius float64) []maptile.Tile {
+	dLat := radius / metersPerDegree
+	dLon := dLat / math.Cos(pt.Lat()*math.Pi/180)
+
+	topLeft := maptile.At(orb.Point{pt.Lon() - dLon, pt.Lat() + dLat}, gridZoom)
+	bottomRight := maptile.At(orb.Point{pt.Lon() + dLon, pt.Lat() - dLat}, gridZoom)
+
+	cells := make([]maptile.Tile, 0, 4)
+	for x := topLeft.X; x <= bottomRight.X; x++ {
+		for y := topLeft.Y; y <= bottomRight.Y; y++ {
+			cells = append(cells, maptile.New(x, y, gridZoom))
+		}
+	}
+	return cells
+}
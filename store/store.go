@@ -0,0 +1,70 @@
+package store
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/breunigs/photoepics/mapillary"
+	"github.com/paulmach/orb"
+)
+
+// Store is what the commands need from a database backend. Photos are
+// identified by their Uid, which is assigned by the backend on insert.
+//
+// Photos are shared between all sessions, but the distance from path and the
+// edges depend on the track that was loaded and are thus kept per session.
+type Store interface {
+	CreateSchema()
+
+	CreateSession(s Session)
+	Session(name string) (Session, bool)
+	Sessions() []string
+	DeleteSession(name string)
+	MarkDone(session string, steps []string)
+	DoneSteps(session string) map[string]bool
+
+	InsertPhotos(session string, photos []*mapillary.Photo)
+	PhotoByKey(key string) mapillary.Photo
+	PhotosNear(session string, pt orb.Point, radius float64) []mapillary.Photo
+	PhotoCount() int64
+
+	InsertEdges(session string, edges []Edge)
+	EdgeCount(session string) int64
+	// ShortestPaths returns up to n chains ordered by cost, which share at
+	// most maxOverlap (0 to 1) of their photos with each other
+	ShortestPaths(session string, from, to mapillary.Photo, n int, maxOverlap float64) []Path
+
+	PurgeEverything()
+	Close()
+}
+
+// Session is a single loaded route, so that multiple can be kept in the
+// database at the same time.
+type Session struct {
+	Name  string
+	Track orb.LineString
+}
+
+// Path is a chain of photos together with the sum of its edge weights
+type Path struct {
+	Photos []mapillary.Photo
+	Cost   float64
+}
+
+// Edge connects two photos (by Uid) that the viewer can transition between.
+// Lower weights are preferred.
+type Edge struct {
+	From, To string
+	Weight   float64
+}
+
+var validSessionName = regexp.MustCompile("^[a-zA-Z0-9_-]+$")
+
+// CheckSessionName ensures the name can be safely used by all backends, e.g.
+// as part of a predicate name.
+func CheckSessionName(name string) error {
+	if !validSessionName.MatchString(name) {
+		return fmt.Errorf("Invalid session name %q. Only alphanumeric characters, underscores and dashes are allowed.", name)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package store
+
+import (
+	"github.com/breunigs/photoepics/mapillary"
+)
+
+const batchSize = 50
+
+// InsertPhotoStream inserts all photos from the stream in batches. After each
+// batch, the steps marked as done in the meantime are persisted. When the
+// producer is interrupted, it closes the stream and the last batch is still
+// written, unless the store cancels its writes as well.
+func InsertPhotoStream(db Store, session string, stream <-chan *mapillary.Photo, cp *Checkpoint) {
+	batch := make([]*mapillary.Photo, 0, batchSize)
+	flush := func() {
+		steps := cp.takePending()
+		if len(batch) > 0 {
+			db.InsertPhotos(session, batch)
+		}
+		cp.commit(steps)
+		batch = batch[:0]
+	}
+
+	for photo := range stream {
+		batch = append(batch, photo)
+		if len(batch) == batchSize {
+			flush()
+		}
+	}
+	flush()
+}
+
+// InsertEdgeStream inserts all edges from the stream in batches. After each
+// batch, the steps marked as done in the meantime are persisted.
+func InsertEdgeStream(db Store, session string, stream <-chan Edge, cp *Checkpoint) {
+	batch := make([]Edge, 0, batchSize)
+	flush := func() {
+		steps := cp.takePending()
+		if len(batch) > 0 {
+			db.InsertEdges(session, batch)
+		}
+		cp.commit(steps)
+		batch = batch[:0]
+	}
+
+	for edge := range stream {
+		batch = append(batch, edge)
+		if len(batch) == batchSize {
+			flush()
+		}
+	}
+	flush()
+}